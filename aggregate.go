@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Aggregate holds the vote totals of a region, keyed by its Kode
+type Aggregate struct {
+	Region         string           `json:"region" bson:"region"`
+	TPS            int64            `json:"tps" bson:"tps"`
+	SuaraSah       int64            `json:"suara_sah" bson:"suara_sah"`
+	SuaraTidakSah  int64            `json:"suara_tidak_sah" bson:"suara_tidak_sah"`
+	SuaraTotal     int64            `json:"suara_total" bson:"suara_total"`
+	PemilihDPT     int64            `json:"pemilih_dpt" bson:"pemilih_dpt"`
+	PenggunaDPTB   int64            `json:"pengguna_dptb" bson:"pengguna_dptb"`
+	PenggunaNonDPT int64            `json:"pengguna_non_dpt" bson:"pengguna_non_dpt"`
+	PenggunaTotal  int64            `json:"pengguna_total" bson:"pengguna_total"`
+	Candidates     map[string]int64 `json:"candidates" bson:"candidates"`
+	Turnout        float64          `json:"turnout" bson:"turnout"`
+	UpdatedAt      time.Time        `json:"updated_at" bson:"updated_at"`
+}
+
+// Turnout of the region, with the same formula as every TPS
+func (a Aggregate) turnout() float64 {
+	return turnout(a.PenggunaTotal, a.PemilihDPT, a.PenggunaDPTB, a.PenggunaNonDPT)
+}
+
+// Province prefix of a stored TPS, ids are 13 digit codes starting with the province code
+var provinceExpr = regionPrefixExpr(2)
+
+// Kode of the region of a stored TPS at the tingkat whose Kode is n digits long
+func regionPrefixExpr(n int) bson.M {
+	return bson.M{"$substrBytes": bson.A{bson.M{"$toString": "$id"}, 0, n}}
+}
+
+// Roll the stored TPS data up per province and write the totals into the aggregates collection
+func aggregate(ctx context.Context, uri string) error {
+	client, err := connectMongo(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mongoDatabase)
+	aggregates, err := aggregateRegions(ctx, db.Collection(mongoCollection), bson.M{}, provinceExpr)
+	if err != nil {
+		return err
+	}
+
+	collection := db.Collection("aggregates")
+	for _, agg := range aggregates {
+		_, err := collection.ReplaceOne(ctx, bson.M{"region": agg.Region}, agg, options.Replace().SetUpsert(true))
+		if err != nil {
+			return fmt.Errorf("error storing aggregate %s: %w", agg.Region, err)
+		}
+	}
+
+	fmt.Println("Aggregated", len(aggregates), "provinces")
+	return nil
+}
+
+// Filter on the TPS inside a region, TPS ids start with the Kode of every region they belong to
+func regionMatch(kode string) (bson.M, error) {
+	prefix, err := strconv.ParseInt(kode, 10, 64)
+	if err != nil || len(kode) > 13 {
+		return nil, fmt.Errorf("invalid region kode %q", kode)
+	}
+	scale := int64(1)
+	for i := len(kode); i < 13; i++ {
+		scale *= 10
+	}
+	return bson.M{"id": bson.M{"$gte": prefix * scale, "$lt": (prefix + 1) * scale}}, nil
+}
+
+// Sum the TPS matching match, grouped by the region computed by regionExpr
+func aggregateRegions(ctx context.Context, collection *mongo.Collection, match bson.M, regionExpr interface{}) ([]Aggregate, error) {
+	opts := options.Aggregate().SetAllowDiskUse(true)
+
+	// Administrasi totals per region
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":              regionExpr,
+			"tps":              bson.M{"$sum": 1},
+			"suara_sah":        bson.M{"$sum": "$administrasi.suarasah"},
+			"suara_tidak_sah":  bson.M{"$sum": "$administrasi.suaratidaksah"},
+			"suara_total":      bson.M{"$sum": "$administrasi.suaratotal"},
+			"pemilih_dpt":      bson.M{"$sum": "$administrasi.pemilihdptj"},
+			"pengguna_dptb":    bson.M{"$sum": "$administrasi.penggunadptbj"},
+			"pengguna_non_dpt": bson.M{"$sum": "$administrasi.penggunanondptj"},
+			"pengguna_total":   bson.M{"$sum": "$administrasi.penggunatotalj"},
+		}}},
+	}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error aggregating totals: %w", err)
+	}
+	var totals []struct {
+		Region    string `bson:"_id"`
+		Aggregate `bson:",inline"`
+	}
+	err = cursor.All(ctx, &totals)
+	if err != nil {
+		return nil, fmt.Errorf("error aggregating totals: %w", err)
+	}
+
+	// Votes per candidate per region, the chart is unwound into one document per candidate
+	cursor, err = collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$project", Value: bson.M{"region": regionExpr, "chart": bson.M{"$objectToArray": "$chart"}}}},
+		{{Key: "$unwind", Value: "$chart"}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"region": "$region", "candidate": "$chart.k"},
+			"votes": bson.M{"$sum": "$chart.v"},
+		}}},
+	}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error aggregating candidates: %w", err)
+	}
+	var candidates []struct {
+		ID struct {
+			Region    string `bson:"region"`
+			Candidate string `bson:"candidate"`
+		} `bson:"_id"`
+		Votes int64 `bson:"votes"`
+	}
+	err = cursor.All(ctx, &candidates)
+	if err != nil {
+		return nil, fmt.Errorf("error aggregating candidates: %w", err)
+	}
+
+	byRegion := make(map[string]*Aggregate, len(totals))
+	aggregates := make([]Aggregate, len(totals))
+	now := time.Now()
+	for i, t := range totals {
+		agg := t.Aggregate
+		agg.Region = t.Region
+		agg.Candidates = map[string]int64{}
+		agg.UpdatedAt = now
+		agg.Turnout = agg.turnout()
+		aggregates[i] = agg
+		byRegion[agg.Region] = &aggregates[i]
+	}
+	for _, c := range candidates {
+		agg, ok := byRegion[c.ID.Region]
+		if !ok {
+			continue
+		}
+		agg.Candidates[c.ID.Candidate] = c.Votes
+	}
+
+	return aggregates, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Length of the Kode of the regions every TPS is summed into: province, kabupaten/kota, kecamatan and kelurahan
+var aggregateRegionLengths = []int{2, 4, 6, 10}
+
+// Shards of the in-memory totals. All the regions of a TPS are in the same province, so a TPS only ever
+// takes the lock of its province's shard.
+const aggregateShards = 16
+
+// AggregateSink sums TPS into per-region totals in memory and only writes those to the aggregates
+// collection, used with STORAGE_BACKEND=aggregates when the individual TPS aren't needed
+type AggregateSink struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+	shards     [aggregateShards]aggregateShard
+}
+
+type aggregateShard struct {
+	mu      sync.Mutex
+	regions map[string]*Aggregate
+	dirty   map[string]bool
+}
+
+func NewAggregateSink(ctx context.Context, uri string) (*AggregateSink, error) {
+	client, err := connectMongo(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := client.Database(mongoDatabase).Collection("aggregates")
+	err = ensureIndex(ctx, collection, mongo.IndexModel{
+		Keys:    bson.D{{Key: "region", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	s := &AggregateSink{client: client, collection: collection}
+	for i := range s.shards {
+		s.shards[i].regions = map[string]*Aggregate{}
+		s.shards[i].dirty = map[string]bool{}
+	}
+	return s, nil
+}
+
+// Add the TPS to the totals of every region it belongs to
+func (s *AggregateSink) Store(ctx context.Context, data TPSData) error {
+	kode := strconv.FormatInt(data.Id, 10)
+	if len(kode) < aggregateRegionLengths[len(aggregateRegionLengths)-1] {
+		return fmt.Errorf("invalid TPS id %d", data.Id)
+	}
+	province, _ := strconv.Atoi(kode[:2])
+	shard := &s.shards[province%aggregateShards]
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	for _, n := range aggregateRegionLengths {
+		region := kode[:n]
+		agg, ok := shard.regions[region]
+		if !ok {
+			agg = &Aggregate{Region: region, Candidates: map[string]int64{}}
+			shard.regions[region] = agg
+		}
+		agg.TPS++
+		agg.SuaraSah += int64(data.Administrasi.SuaraSah)
+		agg.SuaraTidakSah += int64(data.Administrasi.SuaraTidakSah)
+		agg.SuaraTotal += int64(data.Administrasi.SuaraTotal)
+		agg.PemilihDPT += int64(data.Administrasi.PemilihDPTJ)
+		agg.PenggunaDPTB += int64(data.Administrasi.PenggunaDPTBJ)
+		agg.PenggunaNonDPT += int64(data.Administrasi.PenggunaNonDPTJ)
+		agg.PenggunaTotal += int64(data.Administrasi.PenggunaTotalJ)
+		for candidate, votes := range data.Chart {
+			agg.Candidates[candidate] += int64(votes)
+		}
+		shard.dirty[region] = true
+	}
+	return nil
+}
+
+// Write the totals of the regions that changed since the last flush
+func (s *AggregateSink) Flush(ctx context.Context) error {
+	var updates []mongo.WriteModel
+	now := time.Now()
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		for region := range shard.dirty {
+			agg := *shard.regions[region]
+			agg.Candidates = make(map[string]int64, len(shard.regions[region].Candidates))
+			for candidate, votes := range shard.regions[region].Candidates {
+				agg.Candidates[candidate] = votes
+			}
+			agg.UpdatedAt = now
+			agg.Turnout = agg.turnout()
+			updates = append(updates, mongo.NewReplaceOneModel().
+				SetFilter(bson.M{"region": region}).
+				SetReplacement(agg).
+				SetUpsert(true))
+		}
+		shard.dirty = map[string]bool{}
+		shard.mu.Unlock()
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	_, err := s.collection.BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return fmt.Errorf("error storing aggregates: %w", err)
+	}
+	return nil
+}
+
+func (s *AggregateSink) Close() error {
+	err := s.Flush(context.Background())
+	s.client.Disconnect(context.Background())
+	return err
+}
+
+// The totals are locked per shard, so every writer can add to the same sink
+func (s *AggregateSink) Writer() Sink {
+	return aggregateWriter{s}
+}
+
+// aggregateWriter only flushes on Close, the connection is closed with the AggregateSink it came from
+type aggregateWriter struct {
+	*AggregateSink
+}
+
+func (w aggregateWriter) Close() error {
+	return w.Flush(context.Background())
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Anomalies that are almost certainly wrong numbers rather than rounding or typing slips, alerted on ALERT_WEBHOOK
+var alertCodes = map[AnomalyCode]bool{
+	AnomalyCandidateExceedsValid: true,
+	AnomalyChartExceedsValid:     true,
+	AnomalyTurnoutExceeds100:     true,
+}
+
+// Alerts buffered between two posts, anything beyond is only counted so a flood can't eat the memory
+const maxPendingAlerts = 1000
+
+// Alert is a TPS with high severity anomalies, Images are the C1 scans to look at
+type Alert struct {
+	Id        int64       `json:"id"`
+	Path      []PathEntry `json:"path"`
+	Anomalies []Anomaly   `json:"anomalies"`
+	Images    []string    `json:"images"`
+}
+
+// alerter batches alerts and posts them to a webhook at most once per interval
+type alerter struct {
+	url      string
+	interval time.Duration
+	mu       sync.Mutex
+	pending  []Alert
+	dropped  int
+	stopped  chan struct{}
+	done     chan struct{}
+}
+
+// Set in main from ALERT_WEBHOOK and ALERT_INTERVAL_SECONDS, nil while no crawl is running or when disabled
+var (
+	alertWebhook  string
+	alertInterval = 30 * time.Second
+	alerts        *alerter
+)
+
+// Start posting alerts to url every interval, stop sends whatever is still pending
+func startAlerter(url string, interval time.Duration) *alerter {
+	a := &alerter{
+		url:      url,
+		interval: interval,
+		stopped:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Queue an alert for a TPS when it has any high severity anomaly
+func (a *alerter) notify(data TPSData) {
+	if a == nil {
+		return
+	}
+	var severe []Anomaly
+	for _, anomaly := range data.Anomalies {
+		if alertCodes[anomaly.Code] {
+			severe = append(severe, anomaly)
+		}
+	}
+	if len(severe) == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.pending) >= maxPendingAlerts {
+		a.dropped++
+		return
+	}
+	a.pending = append(a.pending, Alert{
+		Id:        data.Id,
+		Path:      data.Path,
+		Anomalies: severe,
+		Images:    data.Images,
+	})
+}
+
+func (a *alerter) stop() {
+	if a == nil {
+		return
+	}
+	close(a.stopped)
+	<-a.done
+}
+
+func (a *alerter) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.send()
+		case <-a.stopped:
+			a.send()
+			return
+		}
+	}
+}
+
+// Post the pending alerts as one batch, a failed post is logged and the batch dropped
+func (a *alerter) send() {
+	a.mu.Lock()
+	batch, dropped := a.pending, a.dropped
+	a.pending, a.dropped = nil, 0
+	a.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(struct {
+		Alerts  []Alert `json:"alerts"`
+		Dropped int     `json:"dropped"`
+	}{batch, dropped})
+	if err != nil {
+		fmt.Println("Error encoding alerts:", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		fmt.Println("Error sending alerts:", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		fmt.Println("Error sending alerts:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		fmt.Println("Error sending alerts: webhook responded with", resp.Status)
+	}
+}
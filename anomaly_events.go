@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Where anomalies are stored, ANOMALIES_STORAGE. Separate storage writes one event per anomaly to the
+// anomalies collection, which is easier to watch as a feed during the count (mongo backend only).
+const (
+	anomaliesEmbedded = "embedded"
+	anomaliesSeparate = "separate"
+	anomaliesBoth     = "both"
+)
+
+var anomalyStorage = anomaliesEmbedded
+
+func parseAnomalyStorage(value string) (string, error) {
+	switch value {
+	case "":
+		return anomaliesEmbedded, nil
+	case anomaliesEmbedded, anomaliesSeparate, anomaliesBoth:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid ANOMALIES_STORAGE %q, expected embedded, separate or both", value)
+}
+
+// AnomalyEvent is an anomaly of a TPS with the numbers it was detected on
+type AnomalyEvent struct {
+	TPSId        int64          `json:"tps_id" bson:"tps_id"`
+	Code         AnomalyCode    `json:"code" bson:"code"`
+	Detail       string         `json:"detail" bson:"detail"`
+	Administrasi Administrasi   `json:"administrasi" bson:"administrasi"`
+	Chart        map[string]int `json:"chart" bson:"chart"`
+	Timestamp    time.Time      `json:"timestamp" bson:"timestamp"`
+	DetectedAt   time.Time      `json:"detected_at" bson:"detected_at"`
+}
+
+// Events are unique per TPS, code, detail and KPU timestamp, so re-crawling an unchanged TPS doesn't repeat them.
+// The detail names what the anomaly is about, two candidates above suara_sah or two small scans are two events.
+var anomalyEventIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "tps_id", Value: 1}, {Key: "code", Value: 1}, {Key: "detail", Value: 1}, {Key: "timestamp", Value: 1}},
+	Options: options.Index().SetUnique(true),
+}
+
+// Name of the unique index earlier versions created without the detail, it would still merge the events
+const oldAnomalyEventIndex = "tps_id_1_code_1_timestamp_1"
+
+// Create anomalyEventIndex, dropping the index it replaces
+func ensureAnomalyEventIndex(ctx context.Context, collection *mongo.Collection) error {
+	_, err := collection.Indexes().DropOne(ctx, oldAnomalyEventIndex)
+	// IndexNotFound (27), and NamespaceNotFound (26) before the collection exists
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && (cmdErr.Code == 26 || cmdErr.Code == 27)) {
+		return fmt.Errorf("error dropping index %s on %s: %w", oldAnomalyEventIndex, collection.Name(), err)
+	}
+	return ensureIndex(ctx, collection, anomalyEventIndex)
+}
+
+// Write the anomalies of a batch as events, detected_at is the time an event was first seen
+func storeAnomalyEvents(ctx context.Context, collection *mongo.Collection, batch []TPSData) error {
+	var models []mongo.WriteModel
+	now := time.Now()
+	for _, data := range batch {
+		for _, anomaly := range data.Anomalies {
+			event := AnomalyEvent{
+				TPSId:        data.Id,
+				Code:         anomaly.Code,
+				Detail:       anomaly.Detail,
+				Administrasi: data.Administrasi,
+				Chart:        data.Chart,
+				Timestamp:    data.Timestamp,
+				DetectedAt:   now,
+			}
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"tps_id": event.TPSId, "code": event.Code, "detail": event.Detail, "timestamp": event.Timestamp}).
+				SetUpdate(bson.M{"$setOnInsert": event}).
+				SetUpsert(true))
+		}
+	}
+	if len(models) == 0 {
+		return nil
+	}
+
+	_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil && !isDuplicateKeyOnly(err) {
+		return fmt.Errorf("error storing anomalies: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// When the writer falls behind the data channel fills up, instead of piling up blocked goroutines the
+// rate limiter is slowed down, and sped back up to RATE_LIMIT_RPS once sends go through immediately again
+var (
+	backpressureMu   sync.Mutex
+	maxRateLimit     = rate.Inf
+	lastSlowdown     time.Time
+	slowdownInterval = time.Second
+)
+
+// After a 429 the rate isn't raised again before Retry-After, or throttleCooldown when KPU didn't send one.
+// throttledFrom is the rate before the first 429, 0 while not throttled.
+var (
+	throttledUntil time.Time
+	throttledFrom  rate.Limit
+)
+
+const throttleCooldown = 30 * time.Second
+
+// Lowest rate backpressure slows the crawl down to, in requests per second
+const minRateLimit = rate.Limit(1)
+
+// Send data to the writer, slowing fetches down while the channel is full. Gives up once the crawl is cancelled
+// or a writer stopped, nothing may be draining the channel anymore then.
+func sendData(ctx context.Context, dataChannel chan<- TPSData, data TPSData) error {
+	select {
+	case dataChannel <- data:
+		relieveBackpressure()
+		return nil
+	default:
+	}
+
+	channelFull.Inc()
+	start := time.Now()
+	defer func() { channelBlockedSeconds.Add(time.Since(start).Seconds()) }()
+	select {
+	case dataChannel <- data:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-writersStopped:
+		return errWritersStopped
+	}
+	applyBackpressure()
+	return nil
+}
+
+var errWritersStopped = errors.New("storage stopped")
+
+// Halve the request rate, at most once per slowdownInterval so a burst of blocked sends doesn't stall the crawl
+func applyBackpressure() {
+	if maxRateLimit == rate.Inf {
+		return
+	}
+	backpressureMu.Lock()
+	defer backpressureMu.Unlock()
+	if time.Since(lastSlowdown) < slowdownInterval {
+		return
+	}
+	lastSlowdown = time.Now()
+
+	limit := max(limiter.Limit()/2, minRateLimit)
+	if limit != limiter.Limit() {
+		limiter.SetLimit(limit)
+		rateLimit.Set(float64(limit))
+	}
+}
+
+// KPU answered 429, halve the request rate right away, at most once per slowdownInterval since concurrent requests
+// get their 429 together. Without RATE_LIMIT_RPS there's no rate to halve, the crawl starts again from CONCURRENCY
+// requests per second. It's sped back up like after backpressure once retryAfter has passed.
+func throttle(retryAfter time.Duration) {
+	backpressureMu.Lock()
+	defer backpressureMu.Unlock()
+	if time.Since(lastSlowdown) < slowdownInterval {
+		return
+	}
+	lastSlowdown = time.Now()
+	if retryAfter <= 0 {
+		retryAfter = throttleCooldown
+	}
+	throttledUntil = lastSlowdown.Add(retryAfter)
+
+	limit := limiter.Limit()
+	if limit == rate.Inf {
+		limit = rate.Limit(concurrency)
+	}
+	if throttledFrom == 0 {
+		throttledFrom = limit
+	}
+	limit = max(limit/2, minRateLimit)
+	limiter.SetLimit(limit)
+	rateLimit.Set(float64(limit))
+}
+
+// Raise the request rate by 10% towards maxRateLimit. Without RATE_LIMIT_RPS the rate goes back to unlimited
+// once it's past where the 429s started.
+func relieveBackpressure() {
+	if limiter.Limit() >= maxRateLimit {
+		return
+	}
+	backpressureMu.Lock()
+	defer backpressureMu.Unlock()
+	if time.Now().Before(throttledUntil) {
+		return
+	}
+
+	limit := limiter.Limit() * 1.1
+	if throttledFrom > 0 && limit > throttledFrom {
+		throttledFrom = 0
+		if maxRateLimit == rate.Inf {
+			limit = rate.Inf
+		}
+	}
+	limit = min(limit, maxRateLimit)
+	limiter.SetLimit(limit)
+	rateLimit.Set(float64(limit))
+}
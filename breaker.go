@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// circuitBreaker pauses every fetch for a cooldown once too many of the recent requests failed,
+// instead of hammering a degraded KPU backend and piling up failed fetches
+type circuitBreaker struct {
+	mu        sync.Mutex
+	results   []bool // ring of the last requests, true for a failure
+	next      int
+	filled    int
+	failures  int
+	threshold float64
+	cooldown  time.Duration
+	openUntil time.Time
+}
+
+// Shared by every request, nil when disabled
+var breaker *circuitBreaker
+
+func newCircuitBreaker(window int, threshold float64, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		results:   make([]bool, window),
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Block while the breaker is open
+func (b *circuitBreaker) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		until := b.openUntil
+		b.mu.Unlock()
+		if !until.After(time.Now()) {
+			return nil
+		}
+
+		select {
+		case <-time.After(time.Until(until)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Record the outcome of a request, missing resources and cancellations say nothing about KPU's health
+func (b *circuitBreaker) record(err error) {
+	if b == nil || errors.Is(err, errNotFound) || errors.Is(err, context.Canceled) {
+		return
+	}
+	failed := err != nil
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.filled == len(b.results) && b.results[b.next] {
+		b.failures--
+	}
+	if b.filled < len(b.results) {
+		b.filled++
+	}
+	b.results[b.next] = failed
+	if failed {
+		b.failures++
+	}
+	b.next = (b.next + 1) % len(b.results)
+
+	if b.filled < len(b.results) || float64(b.failures) < b.threshold*float64(len(b.results)) {
+		return
+	}
+
+	// Trip, and start counting from scratch once the cooldown is over
+	fmt.Printf("Warning: %d of the last %d requests failed, pausing all fetches for %s\n", b.failures, len(b.results), b.cooldown)
+	breakerTrips.Inc()
+	b.openUntil = time.Now().Add(b.cooldown)
+	for i := range b.results {
+		b.results[i] = false
+	}
+	b.next, b.filled, b.failures = 0, 0, 0
+}
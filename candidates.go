@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Chart key (candidate number) to the field name its votes are stored under, e.g. "100026" -> "prabowo_gibran"
+var candidateNames map[string]string
+
+// Load the candidate mapping from inline JSON (CANDIDATES) or from a JSON file. The mapping is optional,
+// without the file votes are only kept under their chart keys.
+func loadCandidates(inline string, path string) error {
+	body := []byte(inline)
+	if len(body) == 0 && path == "" {
+		fmt.Println("Info: no candidate mapping for ELECTION_TYPE, votes are only stored by chart key")
+		candidateNames = nil
+		return nil
+	}
+	if len(body) == 0 {
+		var err error
+		body, err = os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Println("Warning: candidate mapping", path, "not found, votes are only stored by chart key")
+			candidateNames = nil
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading candidates: %w", err)
+		}
+	}
+
+	var names map[string]string
+	err := json.Unmarshal(body, &names)
+	if err != nil {
+		return fmt.Errorf("error parsing candidates: %w", err)
+	}
+	candidateNames = names
+	return nil
+}
+
+// When set, TPS whose chart has a key outside the candidate mapping are rejected instead of stored
+var rejectUnknownCandidates bool
+
+// The candidate mapping is also the set of chart keys to expect, anything goes while it's empty
+func knownCandidate(key string) bool {
+	if len(candidateNames) == 0 {
+		return true
+	}
+	_, ok := candidateNames[key]
+	return ok
+}
+
+// Chart keys outside the candidate mapping, sorted
+func unknownCandidates(chart map[string]int) []string {
+	var unknown []string
+	for key := range chart {
+		if !knownCandidate(key) {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// Votes per candidate name, chart keys without a name are left out
+func namedVotes(chart map[string]int) map[string]int {
+	if len(candidateNames) == 0 || len(chart) == 0 {
+		return nil
+	}
+	votes := make(map[string]int, len(chart))
+	for key, n := range chart {
+		name, ok := candidateNames[key]
+		if !ok {
+			continue
+		}
+		votes[name] = n
+	}
+	return votes
+}
+
+// Name of a chart key for display, the key itself when it has no name
+func candidateName(key string) string {
+	if name, ok := candidateNames[key]; ok {
+		return name
+	}
+	return key
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Top-level location Kode values that have been fully crawled, persisted to a local JSON file
+var (
+	checkpointMu   sync.Mutex
+	checkpointFile string
+	completed      = map[string]bool{}
+)
+
+// Load the checkpoint file so a restarted run can skip already finished locations
+func loadCheckpoints() error {
+	body, err := os.ReadFile(checkpointFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var kodes []string
+	err = json.Unmarshal(body, &kodes)
+	if err != nil {
+		return err
+	}
+
+	checkpointMu.Lock()
+	defer checkpointMu.Unlock()
+	for _, kode := range kodes {
+		completed[kode] = true
+	}
+	return nil
+}
+
+func isComplete(kode string) bool {
+	checkpointMu.Lock()
+	defer checkpointMu.Unlock()
+	return completed[kode]
+}
+
+// Only top-level locations are checkpointed, and only when they were crawled completely and without failures.
+// Their TPS are checkpointed along, so the writers have to be flushed before, and nothing may have been set aside
+// in FAILED_BATCHES_PATH since it's not known which locations those TPS came from.
+func checkpointable(ctx context.Context, loc Location, err error) bool {
+	return loc.Tingkat == 1 && err == nil && !atomicRefresh && ctx.Err() == nil && !tpsLimitReached() && failedBatches.Load() == 0 &&
+		strings.HasPrefix(loc.Kode, filterKode) && !resumesInside(loc.Kode)
+}
+
+func saveCheckpoint(kode string) {
+	err := markComplete(kode)
+	if err != nil {
+		fmt.Println("Error saving checkpoint:", kode, err)
+	}
+}
+
+// Record a location as fully processed and rewrite the checkpoint file
+func markComplete(kode string) error {
+	checkpointMu.Lock()
+	defer checkpointMu.Unlock()
+	completed[kode] = true
+
+	kodes := make([]string, 0, len(completed))
+	for k := range completed {
+		kodes = append(kodes, k)
+	}
+	sort.Strings(kodes)
+
+	body, err := json.Marshal(kodes)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated checkpoint behind
+	tmp := checkpointFile + ".tmp"
+	err = os.WriteFile(tmp, body, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, checkpointFile)
+}
+
+// Forget every completed location, so the next crawl visits everything again
+func resetCheckpoints() error {
+	checkpointMu.Lock()
+	defer checkpointMu.Unlock()
+	completed = map[string]bool{}
+
+	err := os.Remove(checkpointFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
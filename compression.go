@@ -0,0 +1,66 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// Responses are requested compressed and decoded here rather than by the Transport, so the saving can be measured
+const acceptEncoding = "gzip, deflate"
+
+// Bytes received on the wire versus bytes after decoding
+var (
+	bytesReceived atomic.Int64
+	bytesDecoded  atomic.Int64
+)
+
+// countingReader counts the bytes read through it into n
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// Read the whole body, decoding it according to its Content-Encoding
+func readBody(resp *http.Response) ([]byte, error) {
+	var body io.Reader = countingReader{r: resp.Body, n: &bytesReceived}
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	case "deflate":
+		zr, err := zlib.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		body = zr
+	}
+
+	decoded, err := io.ReadAll(body)
+	bytesDecoded.Add(int64(len(decoded)))
+	return decoded, err
+}
+
+// Bandwidth saved by compression over the whole run, part of the summary
+func printBytesSaved() {
+	received, decoded := bytesReceived.Load(), bytesDecoded.Load()
+	if decoded == 0 {
+		return
+	}
+	fmt.Printf("  %-20s %s of %s (%.1f%% saved by compression)\n", "Bytes received",
+		formatThousands(received), formatThousands(decoded), float64(decoded-received)/float64(decoded)*100)
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Config holds every setting, read once at startup from the environment and the optional CONFIG_FILE.
+// Settings are named and documented by their environment variable, see the README.
+type Config struct {
+	// HTTP
+	HTTPTimeout             time.Duration
+	ScraperProxy            string
+	InsecureSkipVerify      bool
+	UserAgent               string
+	RequestHeaders          map[string]string
+	Concurrency             int
+	RateLimitRPS            int
+	BreakerWindow           int
+	BreakerThresholdPercent int
+	BreakerCooldown         time.Duration
+	FetchRetries            int
+	RetryDelay              time.Duration
+	RetryBudget             int
+	RetryBudgetPerSecond    int
+
+	// KPU endpoints
+	BaseURL    string
+	TPSBaseURL string
+
+	// MongoDB
+	MongoURL            string
+	MongoDatabase       string
+	MongoCollection     string
+	MongoWriteConcern   string
+	MongoReadPreference string
+	MongoConnectRetries int
+	MongoConnectTimeout time.Duration
+	MongoBatchSize      int
+	MongoWriteRetries   int
+	FailedBatchesPath   string
+
+	// Storage
+	StorageBackend    string
+	OutputPath        string
+	DryRun            bool
+	AtomicRefresh     bool
+	FailedFetchesPath string
+	FlushInterval     time.Duration
+	Writers           int
+	DataBufferSize    int
+	Pretty            bool
+	SplitByProvince   bool
+	MaxOpenFiles      int
+	StoreFilter       string
+	AnomaliesStorage  string
+	StoreRaw          bool
+	ValidateSchema    bool
+	Fields            *fieldProjection
+	RawDir            string
+
+	// Crawl
+	TPSWorkers          int
+	LocationsInFlight   int
+	SequentialProvinces bool
+	FilterKode          string
+	ResumeFrom          string
+	LeafTingkat         int
+	MaxTingkat          int
+	MaxDepth            int
+	MaxTPS              int
+	Since               string
+	SkipExisting        bool
+	CheckpointFile      string
+	LocationCacheDir    string
+	LocationCacheTTL    time.Duration
+	LocationMemoryCache int
+	Interval            time.Duration
+	IntervalJitter      time.Duration
+	StaleCycles         int
+	ProgressInterval    time.Duration
+	MetricsPort         int
+	OTLPEndpoint        string
+
+	// Validation and alerts
+	UnverifiedModes         map[string]bool
+	Candidates              string
+	CandidatesFile          string
+	RejectUnknownCandidates bool
+	AlertWebhook            string
+	AlertInterval           time.Duration
+
+	// C1 scans
+	DownloadImages   bool
+	ImageDir         string
+	ImageQueue       bool
+	ImageWorkers     int
+	ImageMaxAttempts int
+	ImageS3Bucket    string
+	ImageS3Prefix    string
+	ImageS3Endpoint  string
+	ImageS3Region    string
+	ImageS3PathStyle bool
+	HashImages       bool
+	ImageMetadata    bool
+	ImageMinBytes    int
+	ImageMinWidth    int
+
+	// Other commands
+	Snapshot              string
+	SnapshotRetentionDays int
+	OfficialTotals        string
+	ExportFormat          string
+	ExportFilter          exportFilter
+	ServeAddr             string
+}
+
+// The running configuration, the defaults until main loads the real one
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	cfg, _ := readConfig(func(string) string { return "" })
+	return cfg
+}
+
+// Load the configuration from the environment, falling back to the JSON object of setting names to values in
+// CONFIG_FILE. Every invalid setting is reported, not just the first.
+func loadConfig() (Config, error) {
+	file := map[string]string{}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		var err error
+		file, err = readConfigFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+	return readConfig(func(key string) string {
+		if value, ok := os.LookupEnv(key); ok {
+			return value
+		}
+		return file[key]
+	})
+}
+
+// Values in the file can be strings, numbers or booleans, they're read like the environment
+func readConfigFile(path string) (map[string]string, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(body, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		var s string
+		if json.Unmarshal(value, &s) == nil {
+			values[key] = s
+			continue
+		}
+		values[key] = string(value)
+	}
+	return values, nil
+}
+
+func readConfig(lookup func(string) string) (Config, error) {
+	r := &configReader{lookup: lookup}
+	var cfg Config
+	var err error
+
+	cfg.HTTPTimeout = r.seconds("HTTP_TIMEOUT_SECONDS", 30, 1)
+	cfg.ScraperProxy = r.str("SCRAPER_PROXY", "")
+	cfg.InsecureSkipVerify = r.bool("INSECURE_SKIP_VERIFY")
+	cfg.UserAgent = r.str("USER_AGENT", defaultUserAgent)
+	cfg.RequestHeaders, err = loadRequestHeaders(lookup("REQUEST_HEADERS"))
+	r.check(err)
+	cfg.Concurrency = r.int("CONCURRENCY", 10, 1, 0)
+	cfg.RateLimitRPS = r.int("RATE_LIMIT_RPS", 10, 1, 0)
+	cfg.BreakerWindow = r.int("BREAKER_WINDOW", 100, 0, 0)
+	cfg.BreakerThresholdPercent = r.int("BREAKER_THRESHOLD_PERCENT", 50, 1, 100)
+	cfg.BreakerCooldown = r.seconds("BREAKER_COOLDOWN_SECONDS", 60, 0)
+	cfg.FetchRetries = r.int("FETCH_RETRIES", 3, 0, 0)
+	cfg.RetryDelay = time.Duration(r.int("RETRY_DELAY_MS", 1000, 0, 0)) * time.Millisecond
+	cfg.RetryBudget = r.int("RETRY_BUDGET", 0, 0, 0)
+	cfg.RetryBudgetPerSecond = r.int("RETRY_BUDGET_PER_SECOND", 1, 1, 0)
+
+	cfg.BaseURL = r.str("BASE_URL", baseURL)
+	cfg.TPSBaseURL = tpsBaseURL
+	if electionType := lookup("ELECTION_TYPE"); electionType != "" {
+		cfg.TPSBaseURL, err = tpsBaseURLFor(electionType)
+		r.check(err)
+	}
+	cfg.TPSBaseURL = r.str("TPS_BASE_URL", cfg.TPSBaseURL)
+
+	cfg.MongoURL = r.str("MONGO_DB_URL", "")
+	cfg.MongoDatabase = r.str("MONGO_DB", "sipantau")
+	cfg.MongoCollection = r.str("MONGO_COLLECTION", "data_tps")
+	cfg.MongoWriteConcern = r.str("MONGO_WRITE_CONCERN", "")
+	cfg.MongoReadPreference = r.str("MONGO_READ_PREFERENCE", "")
+	cfg.MongoConnectRetries = r.int("MONGO_CONNECT_RETRIES", 5, 1, 0)
+	cfg.MongoConnectTimeout = r.seconds("MONGO_CONNECT_TIMEOUT_SECONDS", 10, 1)
+	cfg.MongoBatchSize = r.int("MONGO_BATCH_SIZE", 500, 1, 0)
+	cfg.MongoWriteRetries = r.int("MONGO_WRITE_RETRIES", 3, 0, 0)
+	cfg.FailedBatchesPath = r.str("FAILED_BATCHES_PATH", "failed_batches.jsonl")
+
+	cfg.StorageBackend = r.str("STORAGE_BACKEND", "mongo")
+	cfg.OutputPath = r.str("OUTPUT_PATH", "")
+	cfg.DryRun = r.bool("DRY_RUN")
+	cfg.AtomicRefresh = r.bool("ATOMIC_REFRESH")
+	cfg.FailedFetchesPath = r.str("FAILED_FETCHES_PATH", "failed_fetches.jsonl")
+	cfg.FlushInterval = r.seconds("FLUSH_INTERVAL_SECONDS", r.int("MONGO_FLUSH_INTERVAL_SECONDS", 5, 1, 0), 1)
+	cfg.Writers = r.int("WRITERS", 1, 1, 0)
+	cfg.DataBufferSize = r.int("DATA_BUFFER_SIZE", 20, 1, 0)
+	cfg.Pretty = r.bool("PRETTY")
+	cfg.SplitByProvince = r.bool("SPLIT_BY_PROVINCE")
+	cfg.MaxOpenFiles = r.int("MAX_OPEN_FILES", 64, 1, 0)
+	cfg.StoreFilter, err = parseStoreFilter(lookup("STORE_FILTER"))
+	r.check(err)
+	cfg.AnomaliesStorage, err = parseAnomalyStorage(lookup("ANOMALIES_STORAGE"))
+	r.check(err)
+	cfg.StoreRaw = r.bool("STORE_RAW")
+	cfg.ValidateSchema = r.bool("VALIDATE_SCHEMA")
+	cfg.Fields, err = parseFields(lookup("FIELDS"))
+	r.check(err)
+	cfg.RawDir = r.str("RAW_DIR", "")
+
+	cfg.TPSWorkers = r.int("TPS_WORKERS", cfg.Concurrency, 1, 0)
+	cfg.LocationsInFlight = r.int("LOCATIONS_IN_FLIGHT", cfg.Concurrency, 1, 0)
+	cfg.SequentialProvinces = r.bool("SEQUENTIAL_PROVINCES")
+	cfg.FilterKode = r.str("FILTER_KODE", "")
+	cfg.ResumeFrom = r.str("RESUME_FROM", "")
+	cfg.LeafTingkat = r.int("LEAF_TINGKAT", 4, 1, 0)
+	cfg.MaxTingkat = r.int("MAX_TINGKAT", cfg.LeafTingkat, 1, cfg.LeafTingkat)
+	cfg.MaxDepth = r.int("MAX_DEPTH", 6, 1, 0)
+	cfg.MaxTPS = r.int("MAX_TPS", 0, 0, 0)
+	cfg.Since = r.str("SINCE", "")
+	cfg.SkipExisting = r.bool("SKIP_EXISTING")
+	cfg.CheckpointFile = r.str("CHECKPOINT_FILE", "checkpoints.json")
+	cfg.LocationCacheDir = r.str("LOCATION_CACHE_DIR", "")
+	cfg.LocationCacheTTL = r.duration("LOCATION_CACHE_TTL", 24*time.Hour)
+	cfg.LocationMemoryCache = r.int("LOCATION_MEMORY_CACHE", 10000, 0, 0)
+	cfg.Interval, err = parseInterval(lookup("INTERVAL"))
+	r.check(err)
+	cfg.IntervalJitter = r.duration("INTERVAL_JITTER", cfg.Interval/10)
+	cfg.StaleCycles = r.int("STALE_CYCLES", 3, 0, 0)
+	cfg.ProgressInterval = r.seconds("PROGRESS_INTERVAL_SECONDS", 30, 1)
+	cfg.MetricsPort = r.int("METRICS_PORT", 2112, 1, 65535)
+	cfg.OTLPEndpoint = r.str("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+
+	cfg.UnverifiedModes = parseUnverifiedModes(lookup("UNVERIFIED_MODES"))
+	cfg.Candidates = r.str("CANDIDATES", "")
+	// candidates.json maps the presidential candidates, the other races bring their own mapping
+	defaultCandidates := ""
+	if electionType := lookup("ELECTION_TYPE"); electionType == "" || electionType == "ppwp" {
+		defaultCandidates = "candidates.json"
+	}
+	cfg.CandidatesFile = r.str("CANDIDATES_FILE", defaultCandidates)
+	cfg.RejectUnknownCandidates = r.bool("REJECT_UNKNOWN_CANDIDATES")
+	cfg.AlertWebhook = r.str("ALERT_WEBHOOK", "")
+	cfg.AlertInterval = r.seconds("ALERT_INTERVAL_SECONDS", 30, 1)
+
+	cfg.DownloadImages = r.bool("DOWNLOAD_IMAGES")
+	cfg.ImageDir = r.str("IMAGE_DIR", "images")
+	cfg.ImageQueue = r.bool("IMAGE_QUEUE")
+	cfg.ImageWorkers = r.int("IMAGE_WORKERS", cfg.Concurrency, 1, 0)
+	cfg.ImageMaxAttempts = r.int("IMAGE_MAX_ATTEMPTS", 5, 1, 0)
+	cfg.ImageS3Bucket = r.str("IMAGE_S3_BUCKET", "")
+	cfg.ImageS3Prefix = r.str("IMAGE_S3_PREFIX", "")
+	cfg.ImageS3Endpoint = r.str("IMAGE_S3_ENDPOINT", "")
+	cfg.ImageS3Region = r.str("IMAGE_S3_REGION", "us-east-1")
+	cfg.ImageS3PathStyle = r.bool("IMAGE_S3_PATH_STYLE")
+	cfg.HashImages = r.bool("HASH_IMAGES")
+	cfg.ImageMetadata = r.bool("IMAGE_METADATA")
+	cfg.ImageMinBytes = r.int("IMAGE_MIN_BYTES", 10000, 0, 0)
+	cfg.ImageMinWidth = r.int("IMAGE_MIN_WIDTH", 500, 0, 0)
+
+	cfg.Snapshot = r.str("SNAPSHOT", "")
+	cfg.SnapshotRetentionDays = r.int("SNAPSHOT_RETENTION_DAYS", 0, 0, 0)
+	cfg.OfficialTotals = r.str("OFFICIAL_TOTALS", "official_totals.json")
+	cfg.ExportFormat = r.str("EXPORT_FORMAT", "jsonl")
+	cfg.ExportFilter, err = parseExportFilter(lookup("EXPORT_FILTER"))
+	r.check(err)
+	cfg.ServeAddr = r.str("SERVE_ADDR", ":8080")
+
+	return cfg, errors.Join(r.errs...)
+}
+
+// Commands that only work on the stored data in MongoDB
+var mongoCommands = map[string]bool{
+	"aggregate": true, "recheck": true, "validate": true, "--validate-only": true, "download-images": true,
+	"snapshot": true, "diff": true, "reconcile": true, "--compare-to-kpu-official": true, "serve": true, "export": true,
+}
+
+// Check the settings that depend on each other or on the command being run
+func (cfg Config) validate(command string) error {
+	var errs []error
+	crawlsIntoMongo := command == "crawl" && !cfg.DryRun && (cfg.StorageBackend == "mongo" || cfg.StorageBackend == "aggregates")
+	// Without RAW_DIR the raw responses are read from the stored TPS
+	replaysMongo := command == "replay" && (cfg.RawDir == "" || cfg.StorageBackend == "mongo" || cfg.StorageBackend == "aggregates")
+	if (mongoCommands[command] || crawlsIntoMongo || replaysMongo) && cfg.MongoURL == "" {
+		errs = append(errs, errors.New("MONGO_DB_URL is required"))
+	}
+	if command == "export" && cfg.ExportFormat != "csv" && cfg.ExportFormat != "jsonl" && cfg.ExportFormat != "sqlite" {
+		errs = append(errs, fmt.Errorf("invalid EXPORT_FORMAT %q, expected csv, jsonl or sqlite", cfg.ExportFormat))
+	}
+	if command == "crawl" && cfg.Fields != nil {
+		if cfg.StorageBackend != "mongo" && cfg.StorageBackend != "jsonl" {
+			errs = append(errs, errors.New("FIELDS needs the mongo or jsonl backend"))
+		}
+		if cfg.Since == "stored" && !cfg.Fields.keeps("timestamp") {
+			errs = append(errs, errors.New("SINCE=stored needs timestamp in FIELDS"))
+		}
+		if cfg.SkipExisting && !cfg.Fields.keeps("status_suara") {
+			errs = append(errs, errors.New("SKIP_EXISTING needs status_suara in FIELDS"))
+		}
+	}
+	// These read the stored TPS back, with FIELDS whatever wasn't kept would be taken as zero
+	readsStoredTPS := command == "validate" || command == "--validate-only" || command == "recheck" || (command == "replay" && cfg.RawDir == "")
+	if readsStoredTPS && cfg.Fields != nil {
+		errs = append(errs, fmt.Errorf("%s needs complete TPS documents and can't be run with FIELDS", command))
+	}
+	if cfg.SplitByProvince && (command == "crawl" || command == "replay" || command == "export") {
+		backend := cfg.StorageBackend
+		if command == "export" {
+			backend = cfg.ExportFormat
+		}
+		if backend != "csv" && backend != "jsonl" {
+			errs = append(errs, errors.New("SPLIT_BY_PROVINCE needs the csv or jsonl backend"))
+		}
+		// A pretty file is only sorted within what was written between two opens
+		if cfg.OutputPath == "-" || (backend == "jsonl" && cfg.Pretty) {
+			errs = append(errs, errors.New("SPLIT_BY_PROVINCE can't be combined with OUTPUT_PATH=- or PRETTY"))
+		}
+	}
+	if command == "crawl" && cfg.AtomicRefresh {
+		if cfg.StorageBackend != "mongo" {
+			errs = append(errs, errors.New("ATOMIC_REFRESH needs the mongo backend"))
+		}
+		// Only a full crawl can replace the live collection
+		if cfg.FilterKode != "" || cfg.ResumeFrom != "" || cfg.MaxTPS > 0 || cfg.Since != "" || cfg.SkipExisting || cfg.MaxTingkat < cfg.LeafTingkat {
+			errs = append(errs, errors.New("ATOMIC_REFRESH can't be combined with FILTER_KODE, RESUME_FROM, MAX_TPS, SINCE, SKIP_EXISTING or MAX_TINGKAT"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Configure the crawler from cfg
+func (cfg Config) apply() error {
+	var err error
+	httpClient, err = newHTTPClient(cfg.HTTPTimeout, cfg.ScraperProxy, cfg.InsecureSkipVerify)
+	if err != nil {
+		return fmt.Errorf("error configuring HTTP client: %w", err)
+	}
+	if cfg.InsecureSkipVerify {
+		fmt.Println("Warning: INSECURE_SKIP_VERIFY is set, TLS certificates are not verified")
+	}
+	userAgent = cfg.UserAgent
+	requestHeaders = cfg.RequestHeaders
+	concurrency = cfg.Concurrency
+	fetchSem = make(chan struct{}, concurrency)
+	maxRateLimit = rate.Limit(cfg.RateLimitRPS)
+	limiter = rate.NewLimiter(maxRateLimit, 1)
+	throttledUntil, throttledFrom = time.Time{}, 0
+	rateLimit.Set(float64(maxRateLimit))
+	breaker = nil
+	if cfg.BreakerWindow > 0 {
+		breaker = newCircuitBreaker(cfg.BreakerWindow, float64(cfg.BreakerThresholdPercent)/100, cfg.BreakerCooldown)
+	}
+	fetchRetries = cfg.FetchRetries
+	retryDelay = cfg.RetryDelay
+	retryBudget = nil
+	if cfg.RetryBudget > 0 {
+		retryBudget = rate.NewLimiter(rate.Limit(cfg.RetryBudgetPerSecond), cfg.RetryBudget)
+	}
+
+	baseURL = cfg.BaseURL
+	tpsBaseURL = cfg.TPSBaseURL
+	mongoDatabase = cfg.MongoDatabase
+	mongoCollection = cfg.MongoCollection
+	mongoWriteRetries = cfg.MongoWriteRetries
+	failedBatchesPath = cfg.FailedBatchesPath
+
+	atomicRefresh = cfg.AtomicRefresh
+	prettyOutput = cfg.Pretty
+	splitByProvince = cfg.SplitByProvince
+	maxOpenFiles = cfg.MaxOpenFiles
+	storeFilter = cfg.StoreFilter
+	anomalyStorage = cfg.AnomaliesStorage
+	storeRaw = cfg.StoreRaw
+	validateSchema = cfg.ValidateSchema
+	storedFields = cfg.Fields
+	rawDir = cfg.RawDir
+
+	filterKode = cfg.FilterKode
+	resumeFrom = cfg.ResumeFrom
+	leafTingkat = cfg.LeafTingkat
+	maxTingkat = cfg.MaxTingkat
+	maxDepth = cfg.MaxDepth
+	maxTPS = int64(cfg.MaxTPS)
+	initLevelSlots(cfg.LocationsInFlight)
+	checkpointFile = cfg.CheckpointFile
+	staleCycles = cfg.StaleCycles
+	locationCacheDir = cfg.LocationCacheDir
+	locationCacheTTL = cfg.LocationCacheTTL
+	locationMemoryCacheSize = cfg.LocationMemoryCache
+
+	unverifiedModes = cfg.UnverifiedModes
+	rejectUnknownCandidates = cfg.RejectUnknownCandidates
+	alertWebhook = cfg.AlertWebhook
+	alertInterval = cfg.AlertInterval
+
+	downloadImages = cfg.DownloadImages
+	imageDir = cfg.ImageDir
+	imageQueue = cfg.ImageQueue
+	imageStore = nil
+	if cfg.ImageS3Bucket != "" {
+		imageStore, err = newS3ImageStore(context.Background(), cfg.ImageS3Bucket, cfg.ImageS3Prefix, cfg.ImageS3Endpoint,
+			cfg.ImageS3Region, cfg.ImageS3PathStyle)
+		if err != nil {
+			return err
+		}
+	}
+	hashImagesEnabled = cfg.HashImages
+	imageMetadataEnabled = cfg.ImageMetadata
+	imageMinBytes = cfg.ImageMinBytes
+	imageMinWidth = cfg.ImageMinWidth
+	return nil
+}
+
+// configReader reads typed settings, collecting an error for every invalid one
+type configReader struct {
+	lookup func(string) string
+	errs   []error
+}
+
+func (r *configReader) check(err error) {
+	if err != nil {
+		r.errs = append(r.errs, err)
+	}
+}
+
+func (r *configReader) str(key string, def string) string {
+	if value := r.lookup(key); value != "" {
+		return value
+	}
+	return def
+}
+
+func (r *configReader) bool(key string) bool {
+	value := r.lookup(key)
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		r.check(fmt.Errorf("invalid %s %q, expected true or false", key, value))
+	}
+	return b
+}
+
+// An integer of at least lo, and at most hi unless hi is 0
+func (r *configReader) int(key string, def, lo, hi int) int {
+	value := r.lookup(key)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		r.check(fmt.Errorf("invalid %s %q, expected a number", key, value))
+		return def
+	}
+	if n < lo || (hi > 0 && n > hi) {
+		if hi > 0 {
+			r.check(fmt.Errorf("invalid %s %d, expected %d to %d", key, n, lo, hi))
+		} else {
+			r.check(fmt.Errorf("invalid %s %d, expected at least %d", key, n, lo))
+		}
+		return def
+	}
+	return n
+}
+
+func (r *configReader) seconds(key string, def, lo int) time.Duration {
+	return time.Duration(r.int(key, def, lo, 0)) * time.Second
+}
+
+func (r *configReader) duration(key string, def time.Duration) time.Duration {
+	value := r.lookup(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		r.check(fmt.Errorf("invalid %s %q, expected a duration like 90s", key, value))
+		return def
+	}
+	return d
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Read a Config from the given settings alone, without the environment
+func readTestConfig(settings map[string]string) (Config, error) {
+	return readConfig(func(key string) string { return settings[key] })
+}
+
+func TestReadConfigDefaults(t *testing.T) {
+	cfg, err := readTestConfig(nil)
+	if err != nil {
+		t.Fatalf("readConfig: %v", err)
+	}
+	if cfg.Concurrency != 10 || cfg.TPSWorkers != 10 || cfg.ImageWorkers != 10 || cfg.HTTPTimeout != 30*time.Second {
+		t.Errorf("readConfig = concurrency %d, tps workers %d, image workers %d, timeout %s", cfg.Concurrency, cfg.TPSWorkers,
+			cfg.ImageWorkers, cfg.HTTPTimeout)
+	}
+	if cfg.MaxTingkat != cfg.LeafTingkat || cfg.CandidatesFile != "candidates.json" || cfg.StorageBackend != "mongo" {
+		t.Errorf("readConfig = max tingkat %d, candidates file %q, backend %q", cfg.MaxTingkat, cfg.CandidatesFile, cfg.StorageBackend)
+	}
+}
+
+func TestReadConfigBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]string
+		problems []string
+	}{
+		{"lowest", map[string]string{"CONCURRENCY": "1", "BREAKER_THRESHOLD_PERCENT": "1", "FETCH_RETRIES": "0"}, nil},
+		{"highest", map[string]string{"BREAKER_THRESHOLD_PERCENT": "100", "METRICS_PORT": "65535", "MAX_TINGKAT": "4"}, nil},
+		{"no upper bound", map[string]string{"CONCURRENCY": "1000", "MONGO_BATCH_SIZE": "100000"}, nil},
+		{"below", map[string]string{"CONCURRENCY": "0"}, []string{"invalid CONCURRENCY 0, expected at least 1"}},
+		{"above", map[string]string{"BREAKER_THRESHOLD_PERCENT": "101"}, []string{"invalid BREAKER_THRESHOLD_PERCENT 101, expected 1 to 100"}},
+		{"above a setting", map[string]string{"LEAF_TINGKAT": "3", "MAX_TINGKAT": "4"}, []string{"invalid MAX_TINGKAT 4, expected 1 to 3"}},
+		{"not a number", map[string]string{"RATE_LIMIT_RPS": "fast"}, []string{`invalid RATE_LIMIT_RPS "fast", expected a number`}},
+		{"not a bool", map[string]string{"DRY_RUN": "maybe"}, []string{`invalid DRY_RUN "maybe", expected true or false`}},
+		{"not a duration", map[string]string{"LOCATION_CACHE_TTL": "-1h"}, []string{`invalid LOCATION_CACHE_TTL "-1h", expected a duration like 90s`}},
+		{"unknown election", map[string]string{"ELECTION_TYPE": "pilkada"}, []string{`unknown ELECTION_TYPE "pilkada"`}},
+		{"every problem", map[string]string{"CONCURRENCY": "0", "METRICS_PORT": "70000", "PRETTY": "yes"}, []string{
+			"invalid CONCURRENCY 0", "invalid METRICS_PORT 70000", `invalid PRETTY "yes"`}},
+	}
+	for _, tt := range tests {
+		_, err := readTestConfig(tt.settings)
+		if tt.problems == nil {
+			if err != nil {
+				t.Errorf("%s: readConfig = %v, want no error", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: readConfig = nil, want %q", tt.name, tt.problems)
+			continue
+		}
+		for _, problem := range tt.problems {
+			if !strings.Contains(err.Error(), problem) {
+				t.Errorf("%s: readConfig = %v, want %q", tt.name, err, problem)
+			}
+		}
+	}
+}
+
+func TestReadConfigKeepsTheDefaultOfAnInvalidSetting(t *testing.T) {
+	// An invalid setting is reported and the default kept, so settings derived from it are still sane
+	cfg, _ := readTestConfig(map[string]string{"CONCURRENCY": "0"})
+	if cfg.Concurrency != 10 || cfg.TPSWorkers != 10 {
+		t.Errorf("readConfig = concurrency %d, tps workers %d, want 10 and 10", cfg.Concurrency, cfg.TPSWorkers)
+	}
+}
+
+func TestLoadConfigFileOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{"CONCURRENCY": 4, "DRY_RUN": true, "USER_AGENT": "from file", "FETCH_RETRIES": "7"}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	// The environment wins over the file
+	t.Setenv("USER_AGENT", "from env")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.Concurrency != 4 || cfg.TPSWorkers != 4 || !cfg.DryRun || cfg.FetchRetries != 7 {
+		t.Errorf("loadConfig = concurrency %d, tps workers %d, dry run %v, retries %d, want 4, 4, true, 7", cfg.Concurrency,
+			cfg.TPSWorkers, cfg.DryRun, cfg.FetchRetries)
+	}
+	if cfg.UserAgent != "from env" {
+		t.Errorf("loadConfig user agent = %q, want %q", cfg.UserAgent, "from env")
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`CONCURRENCY=4`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bounds := filepath.Join(dir, "bounds.json")
+	if err := os.WriteFile(bounds, []byte(`{"CONCURRENCY": 0}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		path    string
+		problem string
+	}{
+		{"missing", filepath.Join(dir, "missing.json"), "error reading config file"},
+		{"not json", invalid, "error parsing config file"},
+		{"out of bounds", bounds, "invalid CONCURRENCY 0, expected at least 1"},
+	}
+	for _, tt := range tests {
+		t.Setenv("CONFIG_FILE", tt.path)
+		_, err := loadConfig()
+		if err == nil || !strings.Contains(err.Error(), tt.problem) {
+			t.Errorf("%s: loadConfig = %v, want %q", tt.name, err, tt.problem)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	mongo := "mongodb://localhost"
+	tests := []struct {
+		name     string
+		command  string
+		settings map[string]string
+		problem  string
+	}{
+		{"crawl into mongo", "crawl", map[string]string{"MONGO_DB_URL": mongo}, ""},
+		{"crawl without mongo", "crawl", nil, "MONGO_DB_URL is required"},
+		{"dry run", "crawl", map[string]string{"DRY_RUN": "true"}, ""},
+		{"crawl into a file", "crawl", map[string]string{"STORAGE_BACKEND": "jsonl"}, ""},
+		{"aggregates need mongo", "crawl", map[string]string{"STORAGE_BACKEND": "aggregates"}, "MONGO_DB_URL is required"},
+		{"stored data", "export", nil, "MONGO_DB_URL is required"},
+		{"replay from the stored TPS", "replay", map[string]string{"STORAGE_BACKEND": "jsonl"}, "MONGO_DB_URL is required"},
+		{"replay a raw dir", "replay", map[string]string{"STORAGE_BACKEND": "jsonl", "RAW_DIR": "raw"}, ""},
+		{"export format", "export", map[string]string{"MONGO_DB_URL": mongo, "EXPORT_FORMAT": "xml"}, `invalid EXPORT_FORMAT "xml"`},
+		{"fields backend", "crawl", map[string]string{"STORAGE_BACKEND": "csv", "FIELDS": "mode"}, "FIELDS needs the mongo or jsonl backend"},
+		{"fields since", "crawl", map[string]string{"STORAGE_BACKEND": "jsonl", "FIELDS": "mode", "SINCE": "stored"},
+			"SINCE=stored needs timestamp in FIELDS"},
+		{"fields skip existing", "crawl", map[string]string{"STORAGE_BACKEND": "jsonl", "FIELDS": "mode", "SKIP_EXISTING": "true"},
+			"SKIP_EXISTING needs status_suara in FIELDS"},
+		{"fields kept", "crawl", map[string]string{"STORAGE_BACKEND": "jsonl", "FIELDS": "timestamp,status_suara", "SINCE": "stored",
+			"SKIP_EXISTING": "true"}, ""},
+		{"fields recheck", "recheck", map[string]string{"MONGO_DB_URL": mongo, "FIELDS": "mode"},
+			"recheck needs complete TPS documents and can't be run with FIELDS"},
+		{"split backend", "crawl", map[string]string{"MONGO_DB_URL": mongo, "SPLIT_BY_PROVINCE": "true"},
+			"SPLIT_BY_PROVINCE needs the csv or jsonl backend"},
+		{"split export", "export", map[string]string{"MONGO_DB_URL": mongo, "SPLIT_BY_PROVINCE": "true", "EXPORT_FORMAT": "csv"}, ""},
+		{"split pretty", "crawl", map[string]string{"STORAGE_BACKEND": "jsonl", "SPLIT_BY_PROVINCE": "true", "PRETTY": "true"},
+			"SPLIT_BY_PROVINCE can't be combined with OUTPUT_PATH=- or PRETTY"},
+		{"split stdout", "crawl", map[string]string{"STORAGE_BACKEND": "csv", "SPLIT_BY_PROVINCE": "true", "OUTPUT_PATH": "-"},
+			"SPLIT_BY_PROVINCE can't be combined with OUTPUT_PATH=- or PRETTY"},
+		{"atomic refresh", "crawl", map[string]string{"MONGO_DB_URL": mongo, "ATOMIC_REFRESH": "true"}, ""},
+		{"atomic refresh backend", "crawl", map[string]string{"STORAGE_BACKEND": "jsonl", "ATOMIC_REFRESH": "true"},
+			"ATOMIC_REFRESH needs the mongo backend"},
+		{"atomic refresh partial", "crawl", map[string]string{"MONGO_DB_URL": mongo, "ATOMIC_REFRESH": "true", "FILTER_KODE": "11"},
+			"ATOMIC_REFRESH can't be combined with"},
+		{"atomic refresh shallow", "crawl", map[string]string{"MONGO_DB_URL": mongo, "ATOMIC_REFRESH": "true", "MAX_TINGKAT": "2"},
+			"ATOMIC_REFRESH can't be combined with"},
+	}
+	for _, tt := range tests {
+		cfg, err := readTestConfig(tt.settings)
+		if err != nil {
+			t.Fatalf("%s: readConfig: %v", tt.name, err)
+		}
+		err = cfg.validate(tt.command)
+		if tt.problem == "" {
+			if err != nil {
+				t.Errorf("%s: validate(%q) = %v, want no error", tt.name, tt.command, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.problem) {
+			t.Errorf("%s: validate(%q) = %v, want %q", tt.name, tt.command, err, tt.problem)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+// Set by the count command, the crawl then only lists the TPS of every village and counts them per province
+// instead of fetching their data
+var (
+	countOnly      bool
+	tpsPerProvince = map[string]*atomic.Int64{}
+)
+
+// Count the TPS under every province without fetching any vote data, to see how big a crawl will be
+func countTPS(ctx context.Context) error {
+	countOnly = true
+	seenTPS = newSeenSet()
+	// Nothing is stored, so there's no hierarchy to stop at either
+	maxTingkat = leafTingkat
+
+	initialURL := baseURL + "0.json"
+	var provinces []Location
+	attempts, err := withRetry(ctx, func() (err error) {
+		provinces, err = fetchLocations(ctx, initialURL)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error fetching initial locations after %d attempts: %w", attempts, err)
+	}
+	sortByKode(provinces)
+	for _, loc := range provinces {
+		tpsPerProvince[loc.Kode] = &atomic.Int64{}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for _, loc := range provinces {
+		if ctx.Err() != nil {
+			break
+		}
+		if !matchesFilter(loc.Kode) || beforeResumePoint(loc.Kode) {
+			continue
+		}
+		if !acquireLevel(ctx, 0) {
+			break
+		}
+		wg.Add(1)
+		go func(loc Location) {
+			defer wg.Done()
+			defer releaseLevel(0)
+			err := processAndStoreLocation(ctx, baseURL, loc, nil, nil)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(loc)
+	}
+	wg.Wait()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Kode\tProvince\tTPS\t")
+	var total int64
+	for _, loc := range provinces {
+		n := tpsPerProvince[loc.Kode].Load()
+		if n == 0 && !matchesFilter(loc.Kode) {
+			continue
+		}
+		total += n
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", loc.Kode, loc.Nama, formatThousands(n))
+	}
+	fmt.Fprintf(w, "\tTotal\t%s\t\n", formatThousands(total))
+	w.Flush()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(errs) > 0 {
+		err := errors.Join(errs...)
+		return fmt.Errorf("%d locations could not be listed, the counts are incomplete:\n%w", countErrors(err), err)
+	}
+	return nil
+}
+
+// Count the TPS of a village towards its province
+func countVillageTPS(village Location, tps []Location) {
+	n := 0
+	for _, subLoc := range tps {
+		if matchesFilter(subLoc.Kode) && !beforeResumePoint(subLoc.Kode) && seenTPS.add(subLoc.Kode) {
+			n++
+		}
+	}
+	if counter, ok := tpsPerProvince[village.Kode[:min(len(village.Kode), 2)]]; ok {
+		counter.Add(int64(n))
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// CSVSink writes one row per TPS. Chart keys vary between TPS, so rows are kept in memory
+// and the file is written on Close once the full set of candidate columns is known.
+type CSVSink struct {
+	path       string
+	mu         sync.Mutex
+	rows       []TPSData
+	candidates map[string]bool
+}
+
+func NewCSVSink(path string) *CSVSink {
+	return &CSVSink{
+		path:       path,
+		candidates: map[string]bool{},
+	}
+}
+
+func (s *CSVSink) Store(ctx context.Context, data TPSData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Only keep what ends up in the file
+	s.rows = append(s.rows, TPSData{
+		Id:           data.Id,
+		Chart:        data.Chart,
+		Administrasi: data.Administrasi,
+	})
+	for candidate := range data.Chart {
+		s.candidates[candidate] = true
+	}
+	return nil
+}
+
+func (s *CSVSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	candidates := make([]string, 0, len(s.candidates))
+	for candidate := range s.candidates {
+		candidates = append(candidates, candidate)
+	}
+	sort.Strings(candidates)
+
+	file, err := os.Create(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	header := append([]string{"id", "suara_sah", "suara_tidak_sah", "suara_total"}, candidates...)
+	err = w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	// TPS arrive in whatever order the crawl finishes them, sorting keeps two runs diffable
+	sort.Slice(s.rows, func(i, j int) bool { return s.rows[i].Id < s.rows[j].Id })
+	for _, data := range s.rows {
+		row := []string{
+			strconv.FormatInt(data.Id, 10),
+			strconv.Itoa(data.Administrasi.SuaraSah),
+			strconv.Itoa(data.Administrasi.SuaraTidakSah),
+			strconv.Itoa(data.Administrasi.SuaraTotal),
+		}
+		for _, candidate := range candidates {
+			votes, ok := data.Chart[candidate]
+			if !ok {
+				row = append(row, "")
+				continue
+			}
+			row = append(row, strconv.Itoa(votes))
+		}
+		err = w.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	err = w.Error()
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Shards of seenTPS, so the TPS workers of different villages rarely wait on the same lock
+const seenShards = 64
+
+// seenSet is the set of TPS Kodes already handed to the workers in this run. KPU sometimes lists the same TPS
+// under two villages, it's only fetched and stored the first time.
+type seenSet struct {
+	shards [seenShards]seenShard
+}
+
+type seenShard struct {
+	mu    sync.Mutex
+	kodes map[string]bool
+}
+
+func newSeenSet() *seenSet {
+	s := &seenSet{}
+	for i := range s.shards {
+		s.shards[i].kodes = map[string]bool{}
+	}
+	return s
+}
+
+// Add kode to the set, reporting whether it was new
+func (s *seenSet) add(kode string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(kode))
+	shard := &s.shards[h.Sum32()%seenShards]
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if shard.kodes[kode] {
+		return false
+	}
+	shard.kodes[kode] = true
+	return true
+}
+
+// Started over by every crawl
+var seenTPS = newSeenSet()
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Copies of the chart of every TPS at a point in time, one document per TPS tagged with taken_at
+const snapshotCollection = "snapshots"
+
+// snapshotTPS is the part of a TPS kept in a snapshot
+type snapshotTPS struct {
+	Id      int64          `bson:"id"`
+	Chart   map[string]int `bson:"chart"`
+	TakenAt time.Time      `bson:"taken_at"`
+}
+
+// Copy the current chart of every stored TPS into the snapshots collection
+func snapshot(ctx context.Context, uri string) error {
+	client, err := connectMongo(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mongoDatabase)
+	err = ensureIndex(ctx, db.Collection(snapshotCollection), mongo.IndexModel{
+		Keys:    bson.D{{Key: "taken_at", Value: 1}, {Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Copy server side, a snapshot holds every TPS in the country
+	takenAt := time.Now().UTC().Truncate(time.Millisecond)
+	cursor, err := db.Collection(mongoCollection).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$project", Value: bson.M{"_id": 0, "id": 1, "chart": 1, "taken_at": bson.M{"$literal": takenAt}}}},
+		{{Key: "$merge", Value: bson.M{"into": snapshotCollection}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return fmt.Errorf("error taking snapshot: %w", err)
+	}
+	cursor.Close(ctx)
+
+	fmt.Println("Snapshot taken at", takenAt.Format(time.RFC3339Nano))
+
+	if days := config.SnapshotRetentionDays; days > 0 {
+		return pruneSnapshots(ctx, db.Collection(snapshotCollection), takenAt.AddDate(0, 0, -days))
+	}
+	return nil
+}
+
+// Delete the snapshots taken before cutoff. Only the snapshots collection is touched, data_tps is never pruned.
+func pruneSnapshots(ctx context.Context, snapshots *mongo.Collection, cutoff time.Time) error {
+	result, err := snapshots.DeleteMany(ctx, bson.M{"taken_at": bson.M{"$lt": cutoff}})
+	if err != nil {
+		return fmt.Errorf("error pruning snapshots: %w", err)
+	}
+	if result.DeletedCount > 0 {
+		fmt.Println("Pruned", result.DeletedCount, "snapshot documents taken before", cutoff.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Compare the stored TPS against a snapshot, the latest one unless SNAPSHOT names the taken_at of another,
+// and print every TPS whose votes changed with the change per candidate
+func diff(ctx context.Context, uri string) error {
+	client, err := connectMongo(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mongoDatabase)
+	snapshots := db.Collection(snapshotCollection)
+	takenAt, err := findSnapshot(ctx, snapshots, config.Snapshot)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Comparing against the snapshot taken at", takenAt.Format(time.RFC3339Nano))
+
+	// Both sides are streamed in id order and merged, neither fits comfortably in memory
+	byID := options.Find().SetSort(bson.D{{Key: "id", Value: 1}}).SetProjection(bson.M{"id": 1, "chart": 1})
+	previous, err := snapshots.Find(ctx, bson.M{"taken_at": takenAt}, byID)
+	if err != nil {
+		return fmt.Errorf("error reading snapshot: %w", err)
+	}
+	defer previous.Close(context.Background())
+	current, err := db.Collection(mongoCollection).Find(ctx, bson.M{}, byID)
+	if err != nil {
+		return fmt.Errorf("error reading TPS: %w", err)
+	}
+	defer current.Close(context.Background())
+
+	next := func(cursor *mongo.Cursor) (*snapshotTPS, error) {
+		if !cursor.Next(ctx) {
+			return nil, cursor.Err()
+		}
+		var tps snapshotTPS
+		err := cursor.Decode(&tps)
+		return &tps, err
+	}
+
+	var changed, added, removed int
+	totals := map[string]int{}
+	old, err := next(previous)
+	if err != nil {
+		return fmt.Errorf("error reading snapshot: %w", err)
+	}
+	cur, err := next(current)
+	if err != nil {
+		return fmt.Errorf("error reading TPS: %w", err)
+	}
+	for old != nil || cur != nil {
+		switch {
+		case cur == nil || (old != nil && old.Id < cur.Id):
+			removed++
+			old, err = next(previous)
+		case old == nil || cur.Id < old.Id:
+			added++
+			cur, err = next(current)
+		default:
+			if deltas := voteDeltas(old.Chart, cur.Chart); len(deltas) > 0 {
+				changed++
+				printDeltas(cur.Id, old.Chart, cur.Chart, deltas)
+				for candidate, delta := range deltas {
+					totals[candidate] += delta
+				}
+			}
+			old, err = next(previous)
+			if err == nil {
+				cur, err = next(current)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("error comparing snapshot: %w", err)
+		}
+	}
+
+	fmt.Println("Changed:", changed)
+	fmt.Println("New since the snapshot:", added)
+	fmt.Println("Missing since the snapshot:", removed)
+	for _, candidate := range sortedKeys(totals) {
+		fmt.Printf("Total %s: %+d\n", candidateName(candidate), totals[candidate])
+	}
+	return nil
+}
+
+// taken_at of the snapshot to compare with, given as RFC3339 or the latest one when empty
+func findSnapshot(ctx context.Context, snapshots *mongo.Collection, value string) (time.Time, error) {
+	if value != "" {
+		takenAt, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid SNAPSHOT %q: %w", value, err)
+		}
+		return takenAt, nil
+	}
+
+	var latest snapshotTPS
+	err := snapshots.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{Key: "taken_at", Value: -1}})).Decode(&latest)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, errors.New("no snapshot taken yet, run the snapshot command first")
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error finding the latest snapshot: %w", err)
+	}
+	return latest.TakenAt, nil
+}
+
+// Change in votes per chart key, only the candidates that changed
+func voteDeltas(old, cur map[string]int) map[string]int {
+	deltas := map[string]int{}
+	for candidate, votes := range cur {
+		if votes != old[candidate] {
+			deltas[candidate] = votes - old[candidate]
+		}
+	}
+	for candidate, votes := range old {
+		if _, ok := cur[candidate]; !ok && votes != 0 {
+			deltas[candidate] = -votes
+		}
+	}
+	return deltas
+}
+
+func printDeltas(id int64, old, cur map[string]int, deltas map[string]int) {
+	changes := make([]string, 0, len(deltas))
+	for _, candidate := range sortedKeys(deltas) {
+		changes = append(changes, fmt.Sprintf("%s %+d (%d -> %d)", candidateName(candidate), deltas[candidate], old[candidate], cur[candidate]))
+	}
+	fmt.Printf("TPS %d: %s\n", id, strings.Join(changes, ", "))
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
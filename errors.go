@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FetchError is a request to KPU that failed or got an unexpected response, usually transient
+type FetchError struct {
+	URL string
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("fetching %s: %v", e.URL, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// TooManyRequestsError is KPU throttling us with a 429, RetryAfter is how long it asked us to wait, 0 when it didn't say
+type TooManyRequestsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyRequestsError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("too many requests, retry after %v", e.RetryAfter)
+	}
+	return "too many requests"
+}
+
+// Longest Retry-After that's honoured, a date far in the future shouldn't park a worker for the rest of the crawl
+const maxRetryAfter = 10 * time.Minute
+
+// Parse a Retry-After header, either a number of seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	var d time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = t.Sub(now)
+	}
+	return min(max(d, 0), maxRetryAfter)
+}
+
+// ParseError is a response that isn't the JSON we expect, fetching it again won't help
+type ParseError struct {
+	URL string
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parsing %s: %v", e.URL, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// StoreError is a failure writing to the sink, Kode is empty when a whole batch failed to flush
+type StoreError struct {
+	Kode string
+	Err  error
+}
+
+func (e *StoreError) Error() string {
+	if e.Kode == "" {
+		return fmt.Sprintf("storing: %v", e.Err)
+	}
+	return fmt.Sprintf("storing %s: %v", e.Kode, e.Err)
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+// NotJSONError is a response that isn't JSON at all, typically an HTML error page or a maintenance notice.
+// Unlike a ParseError it's usually temporary, so it's retried.
+type NotJSONError struct {
+	URL         string
+	ContentType string
+	Snippet     string
+}
+
+func (e *NotJSONError) Error() string {
+	return fmt.Sprintf("%s is not JSON (Content-Type %q): %q", e.URL, e.ContentType, e.Snippet)
+}
+
+// UnknownCandidateError is a TPS whose chart has keys outside the candidate mapping, rejected with REJECT_UNKNOWN_CANDIDATES
+type UnknownCandidateError struct {
+	URL  string
+	Keys []string
+}
+
+func (e *UnknownCandidateError) Error() string {
+	return fmt.Sprintf("%s has unknown candidates %s", e.URL, strings.Join(e.Keys, ", "))
+}
+
+// SchemaError is a TPS response that doesn't match tps_schema.json, usually because KPU changed the format
+type SchemaError struct {
+	URL      string
+	Problems []string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("%s doesn't match the TPS schema: %s", e.URL, strings.Join(e.Problems, "; "))
+}
+
+// Length of the body snippets included in errors
+const snippetLength = 200
+
+func snippet(body []byte) string {
+	if len(body) > snippetLength {
+		body = body[:snippetLength]
+	}
+	return string(body)
+}
+
+// Check that a response looks like JSON before unmarshalling it, so the error says what came back instead
+func checkJSON(url string, contentType string, body []byte) error {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	trimmed := bytes.TrimSpace(body)
+	looksLikeJSON := len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[' || bytes.Equal(trimmed, []byte("null")))
+	if mediaType == "text/html" || !looksLikeJSON {
+		return &NotJSONError{URL: url, ContentType: contentType, Snippet: snippet(trimmed)}
+	}
+	return nil
+}
+
+// Only fetch errors are worth retrying, a missing resource or malformed response stays that way
+func isRetryable(err error) bool {
+	var parseErr *ParseError
+	var schemaErr *SchemaError
+	return !errors.Is(err, errNotFound) && !errors.As(err, &parseErr) && !errors.As(err, &schemaErr)
+}
+
+// Kind of a failed fetch for the dead letter store
+func errorKind(err error) string {
+	var parseErr *ParseError
+	var fetchErr *FetchError
+	var notJSONErr *NotJSONError
+	var candidateErr *UnknownCandidateError
+	var schemaErr *SchemaError
+	var tooManyErr *TooManyRequestsError
+	switch {
+	case errors.Is(err, errNotFound):
+		return "not_found"
+	case errors.As(err, &notJSONErr):
+		return "not_json"
+	case errors.As(err, &parseErr):
+		return "parse"
+	case errors.As(err, &candidateErr):
+		return "unknown_candidate"
+	case errors.As(err, &schemaErr):
+		return "schema"
+	case errors.As(err, &tooManyErr):
+		return "too_many_requests"
+	case errors.As(err, &fetchErr):
+		return "fetch"
+	}
+	return "other"
+}
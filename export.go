@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportFilter selects the TPS written by the export command, a nil field matches every TPS
+type exportFilter struct {
+	statusSuara *bool
+	statusAdm   *bool
+	anomalies   *bool
+	modes       map[string]bool
+}
+
+// Parse EXPORT_FILTER, comma separated predicates that all have to hold: status_suara, status_adm and anomalies
+// (whether the TPS has any) are true or false, mode is one value or several separated by |
+func parseExportFilter(value string) (exportFilter, error) {
+	var filter exportFilter
+	if value == "" {
+		return filter, nil
+	}
+	for _, predicate := range strings.Split(value, ",") {
+		key, arg, ok := strings.Cut(strings.TrimSpace(predicate), "=")
+		if !ok {
+			return exportFilter{}, fmt.Errorf("invalid EXPORT_FILTER %q, expected key=value", predicate)
+		}
+		if key == "mode" {
+			filter.modes = map[string]bool{}
+			for _, mode := range strings.Split(arg, "|") {
+				filter.modes[normalizeMode(mode)] = true
+			}
+			continue
+		}
+
+		b, err := strconv.ParseBool(arg)
+		if err != nil {
+			return exportFilter{}, fmt.Errorf("invalid EXPORT_FILTER %q, expected true or false", predicate)
+		}
+		switch key {
+		case "status_suara":
+			filter.statusSuara = &b
+		case "status_adm":
+			filter.statusAdm = &b
+		case "anomalies":
+			filter.anomalies = &b
+		default:
+			return exportFilter{}, fmt.Errorf("invalid EXPORT_FILTER %q, expected status_suara, status_adm, anomalies or mode", predicate)
+		}
+	}
+	return filter, nil
+}
+
+// The Mongo filter selecting the matching TPS, so only those are read
+func (f exportFilter) query() bson.M {
+	query := bson.M{}
+	if f.statusSuara != nil {
+		query["statussuara"] = *f.statusSuara
+	}
+	if f.statusAdm != nil {
+		query["statusadm"] = *f.statusAdm
+	}
+	// Missing, null and empty anomalies are all a TPS without any
+	if f.anomalies != nil {
+		query["anomalies.0"] = bson.M{"$exists": *f.anomalies}
+	}
+	if f.modes != nil {
+		modes := make([]string, 0, len(f.modes))
+		for mode := range f.modes {
+			modes = append(modes, mode)
+		}
+		sort.Strings(modes)
+		query["mode"] = bson.M{"$in": modes}
+	}
+	return query
+}
+
+// Write the stored TPS matching filter to one of the file backends, the format is a STORAGE_BACKEND name
+func export(ctx context.Context, uri string, format string, filter exportFilter) error {
+	client, err := connectMongo(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	sink, err := newSink(ctx, format)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", format, err)
+	}
+
+	// Stream the collection, it's far too big to hold in memory
+	collection := client.Database(mongoDatabase).Collection(mongoCollection)
+	cursor, err := collection.Find(ctx, filter.query(), options.Find().SetProjection(bson.M{"raw": 0}))
+	if err != nil {
+		sink.Close()
+		return fmt.Errorf("error reading TPS: %w", err)
+	}
+	defer cursor.Close(context.Background())
+
+	exported := 0
+	for cursor.Next(ctx) {
+		var data TPSData
+		err := cursor.Decode(&data)
+		if err == nil {
+			err = sink.Store(ctx, data)
+		}
+		if err != nil {
+			sink.Close()
+			return fmt.Errorf("error exporting TPS: %w", err)
+		}
+		exported++
+	}
+	err = cursor.Err()
+	if err != nil {
+		sink.Close()
+		return fmt.Errorf("error reading TPS: %w", err)
+	}
+	err = sink.Close()
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", format, err)
+	}
+
+	fmt.Println("Exported", exported, "TPS")
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// FailedFetch records a request that still failed after every retry, so coverage can be audited and re-run later
+type FailedFetch struct {
+	URL      string    `json:"url" bson:"url"`
+	Kode     string    `json:"kode" bson:"kode"`
+	Error    string    `json:"error" bson:"error"`
+	Kind     string    `json:"kind" bson:"kind"`
+	Attempts int       `json:"attempts" bson:"attempts"`
+	Time     time.Time `json:"time" bson:"time"`
+}
+
+// ErrorSink stores failed fetches next to the data sink, it's called directly from the crawl goroutines
+type ErrorSink interface {
+	StoreFailure(ctx context.Context, failure FailedFetch) error
+}
+
+// Dead letter store for the crawl, nil when failures are only logged
+var errorSink ErrorSink
+
+// Log a permanently failed fetch and hand it to the error sink
+func recordFailure(ctx context.Context, url string, kode string, err error, attempts int) {
+	fmt.Println("Giving up on", url, "after", attempts, "attempts:", err)
+	fetchFailures.Add(1)
+	if errorSink == nil {
+		return
+	}
+
+	// Store even when the crawl is being cancelled, the failure is exactly what's worth keeping
+	storeErr := errorSink.StoreFailure(context.WithoutCancel(ctx), FailedFetch{
+		URL:      url,
+		Kode:     kode,
+		Error:    err.Error(),
+		Kind:     errorKind(err),
+		Attempts: attempts,
+		Time:     time.Now(),
+	})
+	if storeErr != nil {
+		fmt.Println("Error storing failed fetch:", url, storeErr)
+	}
+}
+
+// FileErrorSink appends failed fetches as JSON lines, used by the file based backends
+type FileErrorSink struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewFileErrorSink(path string) (*FileErrorSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileErrorSink{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (s *FileErrorSink) StoreFailure(ctx context.Context, failure FailedFetch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(failure)
+}
+
+func (s *FileErrorSink) Close() error {
+	return s.file.Close()
+}
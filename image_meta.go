@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/url"
+	"path"
+	"regexp"
+	"time"
+)
+
+// When set, the C1 scans of every stored TPS are inspected and their metadata stored in image_meta.
+// Scans smaller than either threshold are flagged as possibly blank or a placeholder.
+var (
+	imageMetadataEnabled bool
+	imageMinBytes        = 10000
+	imageMinWidth        = 500
+)
+
+// ImageMeta describes a C1 scan, UploadedAt is only known when the file name carries a timestamp
+type ImageMeta struct {
+	URL        string    `json:"url,omitempty" bson:"url,omitempty"`
+	Bytes      int       `json:"bytes" bson:"bytes"`
+	Width      int       `json:"width" bson:"width"`
+	Height     int       `json:"height" bson:"height"`
+	Format     string    `json:"format" bson:"format"`
+	UploadedAt time.Time `json:"uploaded_at,omitempty" bson:"uploaded_at,omitempty"`
+}
+
+// Sirekap names scans like <kode>-<yyyymmdd>-<hhmmss>--<uuid>.jpg
+var uploadTimestamp = regexp.MustCompile(`-(\d{8}-\d{6})-`)
+
+// Metadata of a downloaded image, only the header is decoded for the dimensions
+func imageMeta(imageURL string, body []byte) (ImageMeta, error) {
+	meta := ImageMeta{URL: imageURL, Bytes: len(body), UploadedAt: uploadedAt(imageURL)}
+	header, format, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return meta, err
+	}
+	meta.Width = header.Width
+	meta.Height = header.Height
+	meta.Format = format
+	return meta, nil
+}
+
+// Upload time in the file name of a scan, zero when it has none
+func uploadedAt(imageURL string) time.Time {
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return time.Time{}
+	}
+	match := uploadTimestamp.FindStringSubmatch(path.Base(u.Path))
+	if match == nil {
+		return time.Time{}
+	}
+	t, err := time.ParseInLocation("20060102-150405", match[1], wib)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// A scan too small to hold a filled in C1 form, only inspected images count
+func smallImage(meta ImageMeta) bool {
+	if meta.Bytes == 0 {
+		return false
+	}
+	return meta.Bytes < imageMinBytes || (meta.Width > 0 && meta.Width < imageMinWidth)
+}
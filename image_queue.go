@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// When set the C1 scans of the stored TPS are queued in imageQueueCollection instead of downloaded during the crawl,
+// the download-images command fetches them afterwards
+var imageQueue bool
+
+const imageQueueCollection = "image_downloads"
+
+// Status of a queued image
+const (
+	imagePending = "pending"
+	imageDone    = "done"
+	imageFailed  = "failed"
+)
+
+// ImageDownload is a C1 scan waiting to be downloaded, or the outcome of downloading it
+type ImageDownload struct {
+	ID        primitive.ObjectID `json:"-" bson:"_id,omitempty"`
+	URL       string             `json:"url" bson:"url"`
+	TPSId     int64              `json:"tps_id" bson:"tps_id"`
+	Index     int                `json:"index" bson:"index"`
+	Status    string             `json:"status" bson:"status"`
+	Attempts  int                `json:"attempts" bson:"attempts"`
+	Error     string             `json:"error,omitempty" bson:"error,omitempty"`
+	Path      string             `json:"path,omitempty" bson:"path,omitempty"`
+	Key       string             `json:"key,omitempty" bson:"key,omitempty"`
+	QueuedAt  time.Time          `json:"queued_at" bson:"queued_at"`
+	UpdatedAt time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+// Every scan is queued once, a scan KPU replaced has a url of its own
+var imageQueueIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "url", Value: 1}},
+	Options: options.Index().SetUnique(true),
+}
+
+// Queue the scans of a batch, scans already queued keep their status
+func queueImages(ctx context.Context, collection *mongo.Collection, batch []TPSData) error {
+	var models []mongo.WriteModel
+	now := time.Now()
+	for _, data := range batch {
+		for i, imageURL := range data.Images {
+			// KPU uses null for pages that haven't been uploaded yet
+			if imageURL == "" {
+				continue
+			}
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"url": imageURL}).
+				SetUpdate(bson.M{"$setOnInsert": ImageDownload{
+					URL:       imageURL,
+					TPSId:     data.Id,
+					Index:     i,
+					Status:    imagePending,
+					QueuedAt:  now,
+					UpdatedAt: now,
+				}}).
+				SetUpsert(true))
+		}
+	}
+	if len(models) == 0 {
+		return nil
+	}
+
+	_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil && !isDuplicateKeyOnly(err) {
+		return fmt.Errorf("error queueing images: %w", err)
+	}
+	return nil
+}
+
+// Download every queued scan that is pending, or failed fewer than IMAGE_MAX_ATTEMPTS times, with IMAGE_WORKERS at once.
+// The queue is walked once in _id order, so an interrupted run picks up again from what's still pending.
+func downloadQueuedImages(ctx context.Context, uri string) error {
+	client, err := connectMongo(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	collection := client.Database(mongoDatabase).Collection(imageQueueCollection)
+	maxAttempts := config.ImageMaxAttempts
+	filter := bson.M{
+		"status":   bson.M{"$in": bson.A{imagePending, imageFailed}},
+		"attempts": bson.M{"$lt": maxAttempts},
+	}
+
+	var downloaded, failed atomic.Int64
+	wg := NewLimitedWaitGroup(config.ImageWorkers)
+	var last primitive.ObjectID
+	for ctx.Err() == nil {
+		// Page through the queue instead of holding a cursor open for as long as the downloads take
+		page := bson.M{"$and": bson.A{filter, bson.M{"_id": bson.M{"$gt": last}}}}
+		cursor, err := collection.Find(ctx, page, options.Find().SetSort(bson.M{"_id": 1}).SetLimit(1000))
+		if err != nil {
+			wg.Wait()
+			return fmt.Errorf("error reading image queue: %w", err)
+		}
+		var images []ImageDownload
+		err = cursor.All(ctx, &images)
+		if err != nil {
+			wg.Wait()
+			return fmt.Errorf("error reading image queue: %w", err)
+		}
+		if len(images) == 0 {
+			break
+		}
+		last = images[len(images)-1].ID
+
+		for _, image := range images {
+			image := image
+			// Blocks while every worker is busy, so the next page is only read once this one is mostly done
+			wg.GoWhenFree(func() {
+				err := downloadQueuedImage(ctx, collection, image)
+				if err != nil {
+					fmt.Println("Error downloading image:", image.URL, err)
+					failed.Add(1)
+					return
+				}
+				downloaded.Add(1)
+			})
+		}
+	}
+	wg.Wait()
+
+	fmt.Println("Downloaded:", downloaded.Load())
+	fmt.Println("Failed:", failed.Load())
+	return ctx.Err()
+}
+
+// Download one scan, or upload it with IMAGE_S3_BUCKET, and record the outcome on its queue entry
+func downloadQueuedImage(ctx context.Context, collection *mongo.Collection, image ImageDownload) error {
+	var dest, key string
+	var err error
+	if imageStore != nil {
+		key, err = imageStore.key(image.TPSId, image.URL)
+		if err == nil {
+			_, err = withRetry(ctx, func() error {
+				return imageStore.upload(ctx, image.URL, key)
+			})
+		}
+	} else {
+		dest, err = imagePath(filepath.Join(imageDir, strconv.FormatInt(image.TPSId, 10)), image.URL)
+		if err == nil {
+			_, err = withRetry(ctx, func() error {
+				return downloadFile(ctx, image.URL, dest)
+			})
+		}
+	}
+	// An interrupted download is left as it was, it'll be retried on the next run
+	if ctx.Err() != nil {
+		return err
+	}
+
+	done := bson.M{"status": imageDone, "path": dest, "updated_at": time.Now()}
+	if key != "" {
+		done = bson.M{"status": imageDone, "key": key, "updated_at": time.Now()}
+	}
+	update := bson.M{"$set": done, "$unset": bson.M{"error": ""}}
+	if err != nil {
+		update = bson.M{"$set": bson.M{"status": imageFailed, "error": err.Error(), "updated_at": time.Now()}, "$inc": bson.M{"attempts": 1}}
+	}
+	_, updateErr := collection.UpdateByID(context.WithoutCancel(ctx), image.ID, update)
+	return errors.Join(err, updateErr)
+}
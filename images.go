@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// When set, the C1 scans of every stored TPS are downloaded into imageDir
+var (
+	downloadImages bool
+	imageDir       string
+)
+
+// When set, the C1 scans of every stored TPS are hashed so replaced scans can be detected across runs
+var hashImagesEnabled bool
+
+// ImageHash is the sha256 of a scan. Documents stored before the url was recorded hold just the hash.
+type ImageHash struct {
+	URL    string `json:"url" bson:"url"`
+	SHA256 string `json:"sha256" bson:"sha256"`
+}
+
+// imageHashDocument is ImageHash without its unmarshal method, so it can decode it the default way
+type imageHashDocument ImageHash
+
+func (h *ImageHash) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	if t == bsontype.String {
+		hash, _, ok := bsoncore.ReadString(data)
+		if !ok {
+			return errors.New("invalid image hash")
+		}
+		*h = ImageHash{SHA256: hash}
+		return nil
+	}
+	var doc imageHashDocument
+	err := bson.RawValue{Type: t, Value: data}.Unmarshal(&doc)
+	*h = ImageHash(doc)
+	return err
+}
+
+// What was made of one scan, for whichever of DOWNLOAD_IMAGES, HASH_IMAGES and IMAGE_METADATA are set
+type scanResult struct {
+	path string
+	key  string
+	hash ImageHash
+	meta ImageMeta
+}
+
+// Fetch every C1 scan of a TPS once, concurrently, and store what each of DOWNLOAD_IMAGES, HASH_IMAGES and
+// IMAGE_METADATA asks for, in the same order as data.Images. A scan that can't be fetched is left out of all of them.
+func processImages(ctx context.Context, data TPSData) TPSData {
+	scans := make([]*scanResult, len(data.Images))
+
+	var wg sync.WaitGroup
+	for i, imageURL := range data.Images {
+		// KPU uses null for pages that haven't been uploaded yet
+		if imageURL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, imageURL string) {
+			defer wg.Done()
+			scan, err := processImage(ctx, data.Id, imageURL)
+			if errors.Is(err, errNotFound) {
+				fmt.Println("Image not found:", imageURL)
+				return
+			}
+			if err != nil {
+				fmt.Println("Error fetching image:", imageURL, err)
+				return
+			}
+			scans[i] = scan
+		}(i, imageURL)
+	}
+	wg.Wait()
+
+	for _, scan := range scans {
+		if scan == nil {
+			continue
+		}
+		if scan.path != "" {
+			data.ImagePaths = append(data.ImagePaths, scan.path)
+		}
+		if scan.key != "" {
+			data.ImageKeys = append(data.ImageKeys, scan.key)
+		}
+		if hashImagesEnabled {
+			data.ImageHashes = append(data.ImageHashes, scan.hash)
+		}
+		if imageMetadataEnabled {
+			data.ImageMeta = append(data.ImageMeta, scan.meta)
+		}
+	}
+	return data
+}
+
+func processImage(ctx context.Context, tpsId int64, imageURL string) (*scanResult, error) {
+	scan := &scanResult{}
+	var body []byte
+	fetch := func() (err error) {
+		if body == nil {
+			body, err = httpGet(ctx, imageURL)
+		}
+		return err
+	}
+	needBody := hashImagesEnabled || imageMetadataEnabled
+
+	// Scans stored by a previous run aren't fetched again, unless they're hashed or inspected
+	if downloadImages && imageStore != nil {
+		key, err := imageStore.key(tpsId, imageURL)
+		if err != nil {
+			return nil, err
+		}
+		exists, err := imageStore.exists(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			err = fetch()
+			if err == nil {
+				err = imageStore.put(ctx, key, body)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		scan.key = key
+	} else if downloadImages {
+		dest, err := imagePath(filepath.Join(imageDir, strconv.FormatInt(tpsId, 10)), imageURL)
+		if err != nil {
+			return nil, err
+		}
+		if _, statErr := os.Stat(dest); statErr == nil {
+			if needBody {
+				body, err = os.ReadFile(dest)
+			}
+		} else {
+			err = fetch()
+			if err == nil {
+				err = writeImage(dest, body)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		scan.path = dest
+	}
+
+	if !needBody {
+		return scan, nil
+	}
+	err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	if hashImagesEnabled {
+		sum := sha256.Sum256(body)
+		scan.hash = ImageHash{URL: imageURL, SHA256: hex.EncodeToString(sum[:])}
+	}
+	if imageMetadataEnabled {
+		// The size is still worth keeping when the image can't be decoded
+		scan.meta, err = imageMeta(imageURL, body)
+		if err != nil {
+			fmt.Println("Error inspecting image:", imageURL, err)
+		}
+	}
+	return scan, nil
+}
+
+// Local file for an image, named after the last segment of its URL
+func imagePath(dir string, imageURL string) (string, error) {
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return "", fmt.Errorf("no file name in url")
+	}
+	return filepath.Join(dir, name), nil
+}
+
+func downloadFile(ctx context.Context, fileURL string, dest string) error {
+	// Already downloaded by a previous run
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+
+	body, err := httpGet(ctx, fileURL)
+	if err != nil {
+		return err
+	}
+	return writeImage(dest, body)
+}
+
+func writeImage(dest string, body []byte) error {
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so an interrupted download is never mistaken for a complete one
+	tmp := dest + ".tmp"
+	err = os.WriteFile(tmp, body, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// Log every TPS in the batch whose scans differ from the hashes stored by a previous run
+func reportReplacedScans(ctx context.Context, collection *mongo.Collection, batch []TPSData) {
+	ids := make([]int64, 0, len(batch))
+	for _, data := range batch {
+		if len(data.ImageHashes) > 0 {
+			ids = append(ids, data.Id)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	cursor, err := collection.Find(ctx,
+		bson.M{"id": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"id": 1, "image_hashes": 1}))
+	if err != nil {
+		fmt.Println("Error looking up previous image hashes:", err)
+		return
+	}
+	var previous []TPSData
+	err = cursor.All(ctx, &previous)
+	if err != nil {
+		fmt.Println("Error looking up previous image hashes:", err)
+		return
+	}
+
+	// Matched by url, hashes stored before the url was recorded can't be compared
+	previousHashes := map[string]string{}
+	for _, data := range previous {
+		for _, hash := range data.ImageHashes {
+			if hash.URL != "" {
+				previousHashes[hash.URL] = hash.SHA256
+			}
+		}
+	}
+
+	for _, data := range batch {
+		for _, hash := range data.ImageHashes {
+			old, ok := previousHashes[hash.URL]
+			if !ok || old == hash.SHA256 {
+				continue
+			}
+			fmt.Println("Info: scan replaced for TPS", data.Id, ":", hash.URL)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+)
+
+// JSONLSink writes each TPS as one JSON object per line, to a file or to stdout when the path is "-".
+// With pretty the TPS are kept in memory instead and written indented and in id order on Close.
+type JSONLSink struct {
+	file   io.Closer
+	w      *bufio.Writer
+	enc    *json.Encoder
+	pretty bool
+	rows   []TPSData
+}
+
+// Set from PRETTY, for output that can be diffed between two runs
+var prettyOutput bool
+
+// Where the records go with OUTPUT_PATH=-, the process's stdout even once the logs were moved away from it
+var recordsOut io.WriteCloser = os.Stdout
+
+// Every log line is printed with fmt.Print* to os.Stdout, pointing it at stderr moves all of them out of the records
+func logToStderr() {
+	os.Stdout = os.Stderr
+}
+
+func NewJSONLSink(path string) (*JSONLSink, error) {
+	return openJSONLSink(path, false)
+}
+
+// With appending the lines are added to what's already in the file instead of replacing it
+func openJSONLSink(path string, appending bool) (*JSONLSink, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appending {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	out := recordsOut
+	if path != "-" {
+		file, err := os.OpenFile(path, flag, 0o666)
+		if err != nil {
+			return nil, err
+		}
+		out = file
+	}
+
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	if prettyOutput {
+		enc.SetIndent("", "  ")
+	}
+	return &JSONLSink{
+		file:   out,
+		w:      w,
+		enc:    enc,
+		pretty: prettyOutput,
+	}, nil
+}
+
+func (s *JSONLSink) Store(ctx context.Context, data TPSData) error {
+	if s.pretty {
+		s.rows = append(s.rows, data)
+		return nil
+	}
+	return s.encode(data)
+}
+
+// Write a TPS with only the FIELDS that are stored, Encode terminates every value with a newline
+func (s *JSONLSink) encode(data TPSData) error {
+	value, err := storedFields.object(data)
+	if err != nil {
+		return err
+	}
+	return s.enc.Encode(value)
+}
+
+func (s *JSONLSink) Flush(ctx context.Context) error {
+	return s.w.Flush()
+}
+
+func (s *JSONLSink) Close() error {
+	// Fields keep the struct order and encoding/json writes map keys like chart and votes sorted, so
+	// sorting the TPS leaves only real changes for a diff between two runs
+	if s.pretty {
+		sort.Slice(s.rows, func(i, j int) bool { return s.rows[i].Id < s.rows[j].Id })
+		for _, data := range s.rows {
+			err := s.encode(data)
+			if err != nil {
+				return err
+			}
+		}
+		s.rows = nil
+	}
+
+	err := s.w.Flush()
+	if err != nil {
+		return err
+	}
+	if s.file == recordsOut {
+		return nil
+	}
+	return s.file.Close()
+}
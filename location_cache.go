@@ -0,0 +1,133 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Location lists are cached on disk under locationCacheDir for locationCacheTTL, keyed by URL. The hierarchy
+// rarely changes, so repeated runs only go to KPU for the TPS data. Empty means no cache.
+var (
+	locationCacheDir string
+	locationCacheTTL = 24 * time.Hour
+)
+
+func locationCachePath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(locationCacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Cached response for url, if there's one younger than the TTL
+func readLocationCache(url string) ([]byte, bool) {
+	if locationCacheDir == "" {
+		return nil, false
+	}
+	path := locationCachePath(url)
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) > locationCacheTTL {
+		return nil, false
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	return body, true
+}
+
+// Cache a response, failing to is only worth a warning since the crawl works without it
+func writeLocationCache(url string, body []byte) {
+	if locationCacheDir == "" {
+		return
+	}
+	err := os.MkdirAll(locationCacheDir, 0755)
+	if err == nil {
+		path := locationCachePath(url)
+		tmp := path + ".tmp"
+		err = os.WriteFile(tmp, body, 0644)
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		fmt.Println("Warning: unable to cache locations :", url, err)
+	}
+}
+
+// Parsed location lists of the current run, so a node that's reached again, e.g. by a retry, isn't fetched again.
+// Bounded to LOCATION_MEMORY_CACHE entries, the least recently used list is evicted first. Reset by every crawl.
+var (
+	locationMemoryCacheSize = 10000
+	locationMemory          = newLocationLRU(locationMemoryCacheSize)
+	locationCacheHits       atomic.Int64
+	locationCacheMisses     atomic.Int64
+)
+
+// locationLRU is a concurrency safe url to []Location cache holding at most size lists
+type locationLRU struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type locationEntry struct {
+	url       string
+	locations []Location
+}
+
+func newLocationLRU(size int) *locationLRU {
+	return &locationLRU{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// A copy of the cached list, callers sort what they get in place
+func (c *locationLRU) get(url string) ([]Location, bool) {
+	if c.size == 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[url]
+	if !ok {
+		locationCacheMisses.Add(1)
+		return nil, false
+	}
+	locationCacheHits.Add(1)
+	c.order.MoveToFront(element)
+	return append([]Location(nil), element.Value.(*locationEntry).locations...), true
+}
+
+func (c *locationLRU) add(url string, locations []Location) {
+	if c.size == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	locations = append([]Location(nil), locations...)
+	if element, ok := c.entries[url]; ok {
+		element.Value.(*locationEntry).locations = locations
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[url] = c.order.PushFront(&locationEntry{url: url, locations: locations})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*locationEntry).url)
+	}
+}
+
+func printLocationCacheHits() {
+	hits, misses := locationCacheHits.Load(), locationCacheMisses.Load()
+	if hits+misses == 0 {
+		return
+	}
+	fmt.Printf("  %-20s %s hits of %s lookups (%.1f%%)\n", "Location cache",
+		formatThousands(hits), formatThousands(hits+misses), float64(hits)/float64(hits+misses)*100)
+}
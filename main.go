@@ -2,19 +2,25 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
-	"strconv"
+	"os/signal"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 type Location struct {
@@ -24,128 +30,726 @@ type Location struct {
 	Tingkat int    `json:"tingkat"`
 }
 
+// One level of the administrative hierarchy above (and including) a TPS
+type PathEntry struct {
+	Kode    string `json:"kode" bson:"kode"`
+	Nama    string `json:"nama" bson:"nama"`
+	Tingkat int    `json:"tingkat" bson:"tingkat"`
+}
+
+// Extend a path with loc, always copying so sibling goroutines never share a backing array
+func appendPath(path []PathEntry, loc Location) []PathEntry {
+	return append(path[:len(path):len(path)], PathEntry{Kode: loc.Kode, Nama: loc.Nama, Tingkat: loc.Tingkat})
+}
+
+// LimitedWaitGroup runs functions in goroutines, at most limit of them at once, and waits for all of them.
+// With Go slots are taken inside the goroutine, so it never blocks the caller, even when called from a running task.
+// GoWhenFree takes the slot first, for loops over large inputs that shouldn't park a goroutine per item.
 type LimitedWaitGroup struct {
-	wg    sync.WaitGroup
-	limit int
-	sem   chan struct{}
+	wg  sync.WaitGroup
+	sem chan struct{}
 }
 
 func NewLimitedWaitGroup(limit int) *LimitedWaitGroup {
 	return &LimitedWaitGroup{
-		wg:    sync.WaitGroup{},
-		limit: limit,
-		sem:   make(chan struct{}, limit),
+		sem: make(chan struct{}, max(limit, 1)),
 	}
 }
 
-func (lwg *LimitedWaitGroup) Add(delta int) {
-	if delta > lwg.limit {
-		panic("delta larger than limit")
-	}
-	lwg.wg.Add(delta)
-	for i := 0; i < delta; i++ {
+// Run fn in a new goroutine as soon as a slot is free
+func (lwg *LimitedWaitGroup) Go(fn func()) {
+	lwg.wg.Add(1)
+	go func() {
+		defer lwg.wg.Done()
 		lwg.sem <- struct{}{}
-	}
+		defer func() { <-lwg.sem }()
+		fn()
+	}()
 }
 
-func (lwg *LimitedWaitGroup) Done() {
-	<-lwg.sem
-	lwg.wg.Done()
+// Run fn in a new goroutine once a slot is free, blocking the caller until then. A task of the same group holds
+// a slot itself, so it must use Go instead.
+func (lwg *LimitedWaitGroup) GoWhenFree(fn func()) {
+	lwg.sem <- struct{}{}
+	lwg.wg.Add(1)
+	go func() {
+		defer lwg.wg.Done()
+		defer func() { <-lwg.sem }()
+		fn()
+	}()
 }
 
+// Wait for every function started with Go or GoWhenFree to return
 func (lwg *LimitedWaitGroup) Wait() {
 	lwg.wg.Wait()
 }
 
-const baseURL = "https://sirekap-obj-data.kpu.go.id/wilayah/pemilu/ppwp/"
+// Shared HTTP client used for every request to KPU, configured in main
+var httpClient = http.DefaultClient
+
+// Maximum number of in-flight HTTP requests across the whole crawl, configured in main
+var (
+	concurrency = 1
+	fetchSem    = make(chan struct{}, concurrency)
+)
+
+// Requests per second allowed towards KPU, shared by every goroutine and configured in main
+var limiter = rate.NewLimiter(rate.Inf, 1)
+
+// The cloned default transport already honors HTTP_PROXY/HTTPS_PROXY, a non empty proxy takes precedence over those.
+// insecure turns off TLS certificate verification, for corporate proxies that intercept HTTPS.
+func newHTTPClient(timeout time.Duration, proxy string, insecure bool) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Every request goes to the same host, so keep plenty of idle connections around for reuse
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 100
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", proxy, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("invalid proxy %q: scheme must be http, https or socks5", proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}, nil
+}
+
+// Identify the scraper instead of going out with Go's default User-Agent
+const defaultUserAgent = "go-sipantau (+https://github.com/hendri-marcolia/go-sipantau)"
+
+// Sent with every request, set from USER_AGENT and REQUEST_HEADERS
+var (
+	userAgent      = defaultUserAgent
+	requestHeaders map[string]string
+)
+
+// Read the extra request headers, a JSON object of header name to value
+func loadRequestHeaders(raw string) (map[string]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var headers map[string]string
+	err := json.Unmarshal([]byte(raw), &headers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REQUEST_HEADERS: %w", err)
+	}
+	return headers, nil
+}
 
 func main() {
+	// Settings can come from the environment alone, the .env file is optional
+	// Printed before OUTPUT_PATH is known, to stderr so it can't end up among records streamed to stdout
 	err := godotenv.Load()
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, "Warning: no .env file, using the environment only")
+	} else if err != nil {
+		fmt.Println("Error loading .env file:", err)
+		os.Exit(1)
+	}
+
+	command := "crawl"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	config, err = loadConfig()
+	err = errors.Join(err, config.validate(command))
+	if err == nil {
+		err = config.apply()
+	}
+	if err != nil {
+		fmt.Println("Invalid configuration:")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// Records are streamed to stdout, keep it for them so the output can be piped
+	if config.OutputPath == "-" {
+		logToStderr()
+	}
+
+	// Cancel the crawl on Ctrl-C / SIGTERM so in-flight requests are aborted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if config.OTLPEndpoint != "" {
+		stopTracing, err := startTracing(ctx, config.OTLPEndpoint)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer stopTracing(context.Background())
+	}
+
+	err = loadCandidates(config.Candidates, config.CandidatesFile)
 	if err != nil {
-		panic("Error loading .env file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if rejectUnknownCandidates && len(candidateNames) == 0 {
+		fmt.Println("REJECT_UNKNOWN_CANDIDATES needs a candidate mapping")
+		os.Exit(1)
 	}
 
-	// Fetch initial JSON
+	switch command {
+	case "crawl":
+		startMetricsServer(config.MetricsPort)
+		if config.Interval == 0 {
+			crawl(ctx)
+			break
+		}
+		crawlEvery(ctx, config.Interval, config.IntervalJitter)
+	case "count", "--count-only":
+		err = countTPS(ctx)
+		if err != nil {
+			fmt.Println("Error counting TPS:", err)
+			os.Exit(1)
+		}
+	case "replay":
+		err = replay(ctx)
+		if err != nil {
+			fmt.Println("Error replaying raw responses:", err)
+			os.Exit(1)
+		}
+	case "export":
+		err = export(ctx, config.MongoURL, config.ExportFormat, config.ExportFilter)
+		if err != nil {
+			fmt.Println("Error exporting:", err)
+			os.Exit(1)
+		}
+	case "aggregate":
+		err = aggregate(ctx, config.MongoURL)
+		if err != nil {
+			fmt.Println("Error aggregating:", err)
+			os.Exit(1)
+		}
+	case "recheck":
+		err = recheckAnomalies(ctx, config.MongoURL)
+		if err != nil {
+			fmt.Println("Error re-checking anomalies:", err)
+			os.Exit(1)
+		}
+	case "validate", "--validate-only":
+		err = validateStored(ctx, config.MongoURL)
+		if err != nil {
+			fmt.Println("Error validating stored data:", err)
+			os.Exit(1)
+		}
+	case "download-images":
+		err = downloadQueuedImages(ctx, config.MongoURL)
+		if err != nil {
+			fmt.Println("Error downloading images:", err)
+			os.Exit(1)
+		}
+	case "snapshot":
+		err = snapshot(ctx, config.MongoURL)
+		if err != nil {
+			fmt.Println("Error taking snapshot:", err)
+			os.Exit(1)
+		}
+	case "diff":
+		err = diff(ctx, config.MongoURL)
+		if err != nil {
+			fmt.Println("Error comparing snapshot:", err)
+			os.Exit(1)
+		}
+	case "reconcile", "--compare-to-kpu-official":
+		err = reconcile(ctx, config.MongoURL, config.OfficialTotals)
+		if err != nil {
+			fmt.Println("Error reconciling:", err)
+			os.Exit(1)
+		}
+	case "serve":
+		err = serve(ctx, config.MongoURL, config.ServeAddr)
+		if err != nil {
+			fmt.Println("Error serving:", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Println("Unknown command:", command)
+		fmt.Println("Usage: go-sipantau [crawl|count|replay|aggregate|recheck|validate|download-images|snapshot|diff|reconcile|serve|export]")
+		os.Exit(2)
+	}
+}
+
+// Walk the whole KPU hierarchy and store every TPS
+func crawl(ctx context.Context) {
+	seenTPS = newSeenSet()
+	locationMemory = newLocationLRU(locationMemoryCacheSize)
+	staleTPS.nextCycle()
+	// A refresh starts from an empty collection, nothing finished by an earlier run can be skipped
+	var err error
+	if !atomicRefresh {
+		err = loadCheckpoints()
+		if err != nil {
+			fmt.Println("Error loading checkpoints:", err)
+			return
+		}
+	}
+
+	err = parseSince(config.Since)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// Fetch initial JSON, everything depends on it so it gets the same retries as the rest of the crawl
 	initialURL := baseURL + "0.json"
-	locations, err := fetchLocations(initialURL)
+	var locations []Location
+	attempts, err := withRetry(ctx, func() (err error) {
+		locations, err = fetchLocations(ctx, initialURL)
+		return err
+	})
 	if err != nil {
-		fmt.Println("Error fetching initial locations:", err)
+		fmt.Println("Error fetching initial locations after", attempts, "attempts:", err)
 		return
 	}
+	warnIfEmpty(initialURL, locations)
+	sortByKode(locations)
+
+	var sink Sink
+	if config.DryRun {
+		sink = &DryRunSink{}
+	} else {
+		sink, err = newSink(context.Background(), config.StorageBackend)
+		if err != nil {
+			fmt.Println("Error opening storage:", err)
+			return
+		}
+	}
+
+	// Failed fetches go next to the data when the backend supports it, and to a JSON lines file otherwise
+	var ok bool
+	errorSink, ok = sink.(ErrorSink)
+	if !ok {
+		fileErrors, err := NewFileErrorSink(config.FailedFetchesPath)
+		if err != nil {
+			fmt.Println("Error opening failed fetches file:", err)
+			return
+		}
+		defer fileErrors.Close()
+		errorSink = fileErrors
+	}
+
+	if anomalyStorage != anomaliesEmbedded {
+		switch sink.(type) {
+		case *MongoSink, *DryRunSink:
+		default:
+			fmt.Println("ANOMALIES_STORAGE=" + anomalyStorage + " needs the mongo backend")
+			return
+		}
+	}
+
+	if imageQueue {
+		switch sink.(type) {
+		case *MongoSink, *DryRunSink:
+		default:
+			fmt.Println("IMAGE_QUEUE needs the mongo backend")
+			return
+		}
+	}
+
+	if sinceStored {
+		timestampLookup, ok = sink.(TimestampLookup)
+		if !ok {
+			fmt.Println("Storage backend can't look up stored TPS, SINCE=stored needs the mongo backend")
+			return
+		}
+	}
+
+	if config.SkipExisting {
+		countedLookup, ok = sink.(CountedLookup)
+		if !ok {
+			fmt.Println("Storage backend can't look up stored TPS, SKIP_EXISTING needs the mongo backend")
+			return
+		}
+	}
+
+	// Without it the hierarchy just isn't stored, unless that's all MAX_TINGKAT asks for
+	locationStorer, ok = sink.(LocationStorer)
+	if !ok && maxTingkat < leafTingkat {
+		fmt.Println("Storage backend can't store locations, MAX_TINGKAT needs the mongo backend")
+		return
+	}
+
+	// Several writers drain the channel when the backend supports it, each with its own batch
+	writers := config.Writers
+	sinks := []Sink{sink}
+	if writers > 1 {
+		multiWriter, ok := sink.(MultiWriter)
+		if !ok {
+			fmt.Println("Storage backend can't be written concurrently, WRITERS needs the mongo backend")
+			return
+		}
+		sinks = make([]Sink, writers)
+		for i := range sinks {
+			sinks[i] = multiWriter.Writer()
+		}
+	}
 
 	// Create a channel with buffer to avoid blocking
-	dataChannel := make(chan TPSData, 20) // Adjust buffer size as needed
+	dataChannel := make(chan TPSData, config.DataBufferSize)
+	writerPool := startWriters(sinks, dataChannel)
+	// A writer only stops early on a store error, everything fetched after it would be lost
+	ctx, cancelCrawl := context.WithCancel(ctx)
+	defer cancelCrawl()
+	crawled := make(chan struct{})
+	go func() {
+		select {
+		case <-writerPool.stopped:
+			fmt.Println("Storage stopped, stopping the crawl")
+			cancelCrawl()
+		case <-ctx.Done():
+		case <-crawled:
+		}
+	}()
 
-	go insertData(context.Background(), dataChannel)
+	if alertWebhook != "" {
+		alerts = startAlerter(alertWebhook, alertInterval)
+		defer func() {
+			alerts.stop()
+			alerts = nil
+		}()
+	}
+
+	stopWorkers := startTPSWorkers(ctx, config.TPSWorkers)
+
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	go reportProgress(progressCtx, config.ProgressInterval)
 
-	// Concurrently process and store locations
+	// Concurrently process and store locations, or one province at a time on small machines
+	sequential := config.SequentialProvinces
 	var wg sync.WaitGroup
+	var failures atomic.Int64
 	for _, loc := range locations {
+		if ctx.Err() != nil || tpsLimitReached() {
+			break
+		}
+		if !matchesFilter(loc.Kode) || beforeResumePoint(loc.Kode) {
+			continue
+		}
+		if sequential {
+			err := processAndStoreLocation(ctx, baseURL, loc, nil, dataChannel)
+			failures.Add(int64(countErrors(err)))
+			flushErr := writerPool.flush()
+			if flushErr != nil {
+				fmt.Println("Error flushing data after", loc.Nama, ":", flushErr)
+			} else if checkpointable(ctx, loc, err) {
+				saveCheckpoint(loc.Kode)
+			}
+			continue
+		}
+		if !acquireLevel(ctx, 0) {
+			break
+		}
 		wg.Add(1)
 		go func(loc Location) {
 			defer wg.Done()
-			err := processAndStoreLocation(context.Background(), baseURL, loc, dataChannel)
+			defer releaseLevel(0)
+			err := processAndStoreLocation(ctx, baseURL, loc, nil, dataChannel)
+			failures.Add(int64(countErrors(err)))
+			if !checkpointable(ctx, loc, err) {
+				return
+			}
+			// Its TPS may still be buffered by the writers, a crash before they're stored must crawl it again
+			err = writerPool.flush()
 			if err != nil {
-				fmt.Println("Error processing and storing location:", err)
+				fmt.Println("Error flushing data after", loc.Nama, ":", err)
+				return
 			}
+			saveCheckpoint(loc.Kode)
 		}(loc)
 	}
 	wg.Wait()
+	stopWorkers()
+	stopProgress()
+	printProgress()
+
+	// No more senders, let the writers drain the channel and flush before exiting
+	close(crawled)
+	close(dataChannel)
+	storeErr := writerPool.wait()
+	if storeErr != nil {
+		fmt.Println("Error storing data:", storeErr)
+	}
+	if writers > 1 {
+		err = sink.Close()
+		if err != nil {
+			fmt.Println("Error closing storage:", err)
+			storeErr = errors.Join(storeErr, err)
+		}
+	}
+	// Set aside batches aren't stored either, even though the writers carried on
+	if n := failedBatches.Load(); n > 0 {
+		storeErr = errors.Join(storeErr, fmt.Errorf("%d batches saved to %s", n, failedBatchesPath))
+	}
+
+	printSummary()
+	if dryRunSink, ok := sink.(*DryRunSink); ok {
+		fmt.Println("Dry run:", dryRunSink.Count(), "TPS records would have been stored")
+	}
+	if ctx.Err() != nil && storeErr != nil {
+		fmt.Println("Crawl stopped, not everything could be stored, see the errors above")
+		return
+	}
+	if ctx.Err() != nil {
+		fmt.Println("Crawl interrupted, shutting down")
+		return
+	}
+	if tpsLimitReached() {
+		fmt.Println("Stopped after MAX_TPS", maxTPS, "TPS")
+		return
+	}
+	if n := failures.Load(); n > 0 {
+		fmt.Println("All locations processed with", n, "failures, see the errors above")
+		if atomicRefresh {
+			fmt.Println("Keeping", mongoCollection, "as it was, the refresh in", refreshCollection(), "is incomplete")
+		}
+		return
+	}
+	if storeErr != nil {
+		fmt.Println("All locations processed, but not everything could be stored, see the errors above")
+		if atomicRefresh {
+			fmt.Println("Keeping", mongoCollection, "as it was, the refresh in", refreshCollection(), "is incomplete")
+		}
+		return
+	}
+	if atomicRefresh && !config.DryRun {
+		err := swapRefresh(ctx, config.MongoURL)
+		if err != nil {
+			fmt.Println("Error swapping in the refreshed collection:", err)
+			return
+		}
+		fmt.Println("Swapped", refreshCollection(), "in as", mongoCollection)
+	}
 	fmt.Println("All locations processed and stored successfully!")
 }
 
-func fetchLocations(url string) ([]Location, error) {
-	// fmt.Println("Fetching location : ", url)
-	resp, err := http.Get(url)
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+	return fetchBody(ctx, url, false)
+}
+
+// Fetch a JSON document, HTML error pages and maintenance notices are reported as a NotJSONError
+func httpGetJSON(ctx context.Context, url string) ([]byte, error) {
+	return fetchBody(ctx, url, true)
+}
+
+// Fetch url and return the body. With wantJSON a body that isn't JSON is a NotJSONError,
+// and counts as a failure for the breaker like any other error.
+func fetchBody(ctx context.Context, url string, wantJSON bool) ([]byte, error) {
+	// Hold off while KPU is failing, then wait for our turn before taking a slot, so slots aren't held while rate limited
+	err := breaker.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = limiter.Wait(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	// Wait for a free slot so the whole recursion tree shares one concurrency limit
+	select {
+	case fetchSem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-fetchSem }()
+
+	fetchesTotal.Inc()
+	fetchesInFlight.Inc()
+	defer fetchesInFlight.Dec()
+	start := time.Now()
+	body, contentType, err := doGet(ctx, url)
+	recordTiming(url, time.Since(start))
+	if err != nil {
+		breaker.record(err)
+		fetchesFailed.Inc()
+		return nil, &FetchError{URL: url, Err: err}
+	}
+	// A maintenance page comes back as 200, it's only a failure once it turns out not to be JSON
+	if wantJSON {
+		err = checkJSON(url, contentType, body)
+	}
+	breaker.record(err)
 	if err != nil {
 		return nil, err
 	}
+	return body, nil
+}
+
+func doGet(ctx context.Context, url string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	for key, value := range requestHeaders {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", errNotFound
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		throttle(retryAfter)
+		return nil, "", &TooManyRequestsError{RetryAfter: retryAfter}
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The body of an error response usually says what went wrong
+		body, _ := readBody(resp)
+		return nil, "", fmt.Errorf("unexpected status %s: %q", resp.Status, snippet(body))
+	}
+
+	body, err := readBody(resp)
+	return body, resp.Header.Get("Content-Type"), err
+}
+
+var errNotFound = errors.New("not found")
+
+func fetchLocations(ctx context.Context, url string) ([]Location, error) {
+	// fmt.Println("Fetching location : ", url)
+	ctx, span := startSpan(ctx, "fetchLocations", kodeOf(url))
+	defer span.End()
+	if locations, ok := locationMemory.get(url); ok {
+		span.SetAttributes(attribute.Bool("cached", true))
+		return locations, nil
+	}
+	body, cached := readLocationCache(url)
+	span.SetAttributes(attribute.Bool("cached", cached))
+	if !cached {
+		var err error
+		body, err = httpGetJSON(ctx, url)
+		if err != nil {
+			return nil, spanError(span, err)
+		}
+	}
 
 	var locations []Location
-	err = json.Unmarshal(body, &locations)
+	err := json.Unmarshal(body, &locations)
 	if err != nil {
-		return nil, err
+		return nil, spanError(span, &ParseError{URL: url, Err: err})
+	}
+	// Empty lists are suspicious, so they're fetched again next time
+	if len(locations) > 0 {
+		locationMemory.add(url, locations)
+		if !cached {
+			writeLocationCache(url, body)
+		}
 	}
 
 	return locations, nil
 }
 
-func fetchDataTPS(url string) (data TPSData, err error) {
+// A failed fetch always returns a zero TPSData, never whatever a malformed response partially decoded into
+func fetchDataTPS(ctx context.Context, url string) (TPSData, error) {
 	fmt.Println("Fetching data TPS : ", url)
-	resp, err := http.Get(url)
+	ctx, span := startSpan(ctx, "fetchDataTPS", kodeOf(url))
+	defer span.End()
+	body, err := httpGetJSON(ctx, url)
 	if err != nil {
-		return
+		return TPSData{}, spanError(span, err)
 	}
-	defer resp.Body.Close()
+	data, err := parseDataTPS(url, body)
+	if err != nil {
+		return TPSData{}, spanError(span, err)
+	}
+	if storeRaw {
+		data.Raw, err = gzipBytes(body)
+		if err != nil {
+			return TPSData{}, spanError(span, err)
+		}
+	}
+	return data, nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
+// Decode a TPS response, url is only used in errors and warnings
+func parseDataTPS(url string, body []byte) (TPSData, error) {
+	if validateSchema {
+		err := checkSchema(url, tpsSchema, body)
+		if err != nil {
+			return TPSData{}, err
+		}
+	}
+	var data TPSData
+	err := json.Unmarshal(body, &data)
 	if err != nil {
-		return
+		return TPSData{}, &ParseError{URL: url, Err: err}
 	}
-	err = json.Unmarshal(body, &data)
+	data.Mode = normalizeMode(data.Mode)
+
+	// Keep the record even when TS can't be parsed, Timestamp is just left as zero
+	data.Timestamp, err = parseTS(data.TS)
 	if err != nil {
-		return
+		fmt.Println("Warning: unable to parse TS :", url, err)
 	}
-	return
+	return data, nil
+}
+
+// KPU timestamps without an explicit offset are in WIB (UTC+7)
+var wib = time.FixedZone("WIB", 7*60*60)
+
+var tsLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
 
+func parseTS(ts string) (time.Time, error) {
+	if ts == "" {
+		return time.Time{}, nil
+	}
+	var err error
+	for _, layout := range tsLayouts {
+		var t time.Time
+		t, err = time.ParseInLocation(layout, ts, wib)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
 }
 
 type TPSData struct {
-	Id           int64          `json:"id"`
-	Mode         string         `json:"mode"`
-	Chart        map[string]int `json:"chart"`
-	Images       []string       `json:"images"`
-	Administrasi Administrasi   `json:"administrasi"`
-	PSU          interface{}    `json:"psu"`
-	TS           string         `json:"ts"`
-	StatusSuara  bool           `json:"status_suara"`
-	StatusAdm    bool           `json:"status_adm"`
+	Id           int64              `json:"id"`
+	Mode         string             `json:"mode"`
+	Chart        Chart              `json:"chart"`
+	Votes        map[string]int     `json:"votes,omitempty" bson:"votes,omitempty"`
+	Percentages  map[string]float64 `json:"percentages,omitempty" bson:"percentages,omitempty"`
+	Images       []string           `json:"images"`
+	Administrasi Administrasi       `json:"administrasi"`
+	PSU          *PSU               `json:"psu"`
+	TS           string             `json:"ts"`
+	Timestamp    time.Time          `json:"timestamp" bson:"timestamp"`
+	StatusSuara  bool               `json:"status_suara"`
+	StatusAdm    bool               `json:"status_adm"`
+	Stale        bool               `json:"stale,omitempty" bson:"stale,omitempty"`
+	LastUpdated  time.Time          `json:"last_updated" bson:"last_updated"`
+	Anomalies    []Anomaly          `json:"anomalies" bson:"anomalies"`
+	Turnout      float64            `json:"turnout" bson:"turnout"`
+	ImagePaths   []string           `json:"image_paths,omitempty" bson:"image_paths,omitempty"`
+	ImageKeys    []string           `json:"image_keys,omitempty" bson:"image_keys,omitempty"`
+	ImageHashes  []ImageHash        `json:"image_hashes,omitempty" bson:"image_hashes,omitempty"`
+	ImageMeta    []ImageMeta        `json:"image_meta,omitempty" bson:"image_meta,omitempty"`
+	Path         []PathEntry        `json:"path" bson:"path"`
+	Raw          []byte             `json:"raw,omitempty" bson:"raw,omitempty"`
+
+	// Span of the fetch, the store is traced as part of it
+	spanContext trace.SpanContext
 }
 
 type Administrasi struct {
@@ -169,105 +773,358 @@ type Administrasi struct {
 	PenggunaNonDPTP int `json:"pengguna_non_dpt_p"`
 }
 
-// Function to receive data from channel and insert into MongoDB
-func insertData(ctx context.Context, dataChannel <-chan TPSData) error {
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(os.Getenv("MONGO_DB_URL")))
+// PSU (pemungutan suara ulang) describes a re-vote held at the TPS. KPU sends null when there was none,
+// and otherwise either a plain string or an object, both are normalized into this struct so the
+// stored value always has the same shape. Value holds the string (or the object's "status" field),
+// Detail holds the whole object when one was sent.
+type PSU struct {
+	Value  string                 `json:"value" bson:"value"`
+	Detail map[string]interface{} `json:"detail,omitempty" bson:"detail,omitempty"`
+}
+
+func (p *PSU) UnmarshalJSON(b []byte) error {
+	var raw interface{}
+	err := json.Unmarshal(b, &raw)
 	if err != nil {
-		fmt.Println("Error connecting to MongoDB:", err)
-		return fmt.Errorf("failed to connect to MongoDB: %w", err)
+		return err
 	}
-	defer client.Disconnect(context.Background())
 
-	// Database & Collection
-	db := client.Database("sipantau")
-	collection := db.Collection("data_tps")
-	indexModel := mongo.IndexModel{
-		Keys:    bson.D{{Key: "id", Value: -1}},
-		Options: options.Index().SetUnique(true),
-	}
-	_, err = collection.Indexes().CreateOne(ctx, indexModel)
-	if err != nil {
-		panic(err)
+	switch v := raw.(type) {
+	case string:
+		p.Value = v
+	case map[string]interface{}:
+		p.Detail = v
+		if status, ok := v["status"]; ok && status != nil {
+			p.Value = fmt.Sprint(status)
+		}
+	case nil:
+	default:
+		p.Value = fmt.Sprint(v)
 	}
+	return nil
+}
 
-	// Receive data from channel and insert
-	for data := range dataChannel {
-		// Access and store relevant data based on your needs
+// Chart holds the votes per chart key. The presidential race sends a plain number per candidate, the
+// legislative races send an object per party, its jml_suara_total is stored as the party's votes.
+type Chart map[string]int
 
-		// Convert data to bson.M for insertion
-		// doc, err := bson.M(data)
-		// if err != nil {
-		// return fmt.Errorf("error converting data to bson.M: %v", err)
-		// }
-		// fmt.Println("Received data on Channel :", data)
+func (c *Chart) UnmarshalJSON(b []byte) error {
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal(b, &raw)
+	if err != nil {
+		return err
+	}
+	if raw == nil {
+		*c = nil
+		return nil
+	}
 
-		_, err := collection.InsertOne(ctx, data)
-		if err != nil {
-			return fmt.Errorf("error inserting document: %v", err)
+	chart := make(Chart, len(raw))
+	for key, value := range raw {
+		var votes int
+		if json.Unmarshal(value, &votes) == nil {
+			chart[key] = votes
+			continue
 		}
-
-		// fmt.Printf("Successfully stored data\n")
+		var party struct {
+			Total *int `json:"jml_suara_total"`
+		}
+		err := json.Unmarshal(value, &party)
+		if err != nil || party.Total == nil {
+			return fmt.Errorf("unexpected chart value for %s: %s", key, value)
+		}
+		chart[key] = *party.Total
 	}
-	fmt.Printf("Ended")
-
+	*c = chart
 	return nil
 }
 
-func fetchAndStoreTPS(ctx context.Context, burl string, loc Location, dataChannel chan TPSData) error {
-	// Store the current location in MongoDB
+func fetchAndStoreTPS(ctx context.Context, burl string, loc Location, path []PathEntry, dataChannel chan TPSData) error {
+	// Store the current location in MongoDB, a failure is only logged since the TPS matter more
+	path = appendPath(path, loc)
+	storeLocation(ctx, loc, path)
 	url := burl + loc.Kode + ".json"
-	subLocations, err := fetchLocations(url)
-	if err != nil {
+	var subLocations []Location
+	attempts, err := withRetry(ctx, func() (err error) {
+		subLocations, err = fetchLocations(ctx, url)
 		return err
+	})
+	if err != nil {
+		recordFailure(ctx, url, loc.Kode, err, attempts)
+		return fmt.Errorf("location %s: %w", loc.Kode, err)
+	}
+	warnIfEmpty(url, subLocations)
+	sortByKode(subLocations)
+	locationsVisited.Add(1)
+	if countOnly {
+		countVillageTPS(loc, subLocations)
+		return nil
 	}
+	tpsDiscovered.Add(int64(len(subLocations)))
+	stored := storedTimestamps(ctx, subLocations)
+	existing := existingTPS(ctx, subLocations)
 
-	// Concurrently process and store sub-locations
-	wg2 := NewLimitedWaitGroup(1)
+	// Hand every TPS to the worker pool and wait for the whole village to be done
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
 	for _, subLoc := range subLocations {
-		wg2.Add(1)
-		go func(subLoc Location) {
-			defer wg2.Done()
-			data, err := fetchDataTPS(strings.TrimRight(strings.ReplaceAll(url, "wilayah/pemilu/ppwp", "pemilu/hhcw/ppwp"), ".json") + "/" + subLoc.Kode + ".json")
-			if err != nil {
-				fmt.Println("Error processing TPS:", subLoc.Kode, err)
-			}
-			data.Id, _ = strconv.ParseInt(subLoc.Kode, 10, 64)
-			if data.StatusSuara {
-				dataChannel <- data
-			}
-		}(subLoc)
-
+		if ctx.Err() != nil {
+			break
+		}
+		if !matchesFilter(subLoc.Kode) || beforeResumePoint(subLoc.Kode) {
+			continue
+		}
+		if !seenTPS.add(subLoc.Kode) {
+			fmt.Printf("Warning: TPS %s listed again under %s, skipping the duplicate\n", subLoc.Kode, loc.Kode)
+			tpsProcessed.Add(1)
+			duplicateTPS.Add(1)
+			continue
+		}
+		if isExisting(subLoc, existing) {
+			tpsProcessed.Add(1)
+			tpsSkipped.Add(1)
+			continue
+		}
+		if !claimTPS() {
+			break
+		}
+		wg.Add(1)
+		job := tpsJob{
+			tps:         subLoc,
+			path:        path,
+			stored:      stored,
+			dataChannel: dataChannel,
+			done: func(err error) {
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+				wg.Done()
+			},
+		}
+		select {
+		case tpsJobs <- job:
+		case <-ctx.Done():
+			wg.Done()
+		}
 	}
+	wg.Wait()
 
-	return nil
+	return errors.Join(errs...)
 }
 
-func processAndStoreLocation(ctx context.Context, burl string, loc Location, dataChannel chan TPSData) error {
+func processAndStoreLocation(ctx context.Context, burl string, loc Location, path []PathEntry, dataChannel chan TPSData) error {
+	// Skip subtrees finished by a previous run
+	if isComplete(loc.Kode) {
+		fmt.Println("Skipping completed location : ", loc.Kode)
+		return nil
+	}
+
+	// Store the location itself so the hierarchy can be searched. Crawling only the hierarchy that's all there is
+	// to do, so a location that can't be stored fails there, and the crawl stops at MAX_TINGKAT.
+	err := storeLocation(ctx, loc, appendPath(path, loc))
+	if maxTingkat < leafTingkat {
+		if err != nil {
+			return err
+		}
+		if loc.Tingkat >= maxTingkat {
+			return nil
+		}
+	}
+
+	// The real hierarchy has a fixed depth, anything deeper is a malformed or self-referencing response
+	if len(path) >= maxDepth {
+		fmt.Println("Error: location", loc.Kode, "is nested deeper than MAX_DEPTH", maxDepth, "not crawling further")
+		return fmt.Errorf("location %s: nested deeper than %d levels", loc.Kode, maxDepth)
+	}
+
 	// Fetch JSON for the current location
+	path = appendPath(path, loc)
 	url := burl + loc.Kode + ".json"
-	subLocations, err := fetchLocations(url)
-	if err != nil {
+	// The children of a location are listed under its Kode
+	childURL := burl + loc.Kode + "/"
+	var subLocations []Location
+	attempts, err := withRetry(ctx, func() (err error) {
+		subLocations, err = fetchLocations(ctx, url)
 		return err
+	})
+	if err != nil {
+		recordFailure(ctx, url, loc.Kode, err, attempts)
+		return fmt.Errorf("location %s: %w", loc.Kode, err)
 	}
+	warnIfEmpty(url, subLocations)
+	sortByKode(subLocations)
+	locationsVisited.Add(1)
 
-	// Concurrently process and store sub-locations
-	wg := NewLimitedWaitGroup(1)
+	// Concurrently process and store sub-locations, failures are logged where they happen and collected here
+	var mu sync.Mutex
+	var errs []error
+	wg := NewLimitedWaitGroup(concurrency)
 	for _, subLoc := range subLocations {
-		wg.Add(1)
-		go func(subLoc Location) {
-			defer wg.Done()
+		if ctx.Err() != nil || tpsLimitReached() {
+			break
+		}
+		if !matchesFilter(subLoc.Kode) || beforeResumePoint(subLoc.Kode) {
+			continue
+		}
+		if !acquireLevel(ctx, len(path)) {
+			break
+		}
+		subLoc := subLoc
+		// Every level has a group of its own, so the parent waiting for a slot can't hold up its children
+		wg.GoWhenFree(func() {
+			defer releaseLevel(len(path))
 			fmt.Println("Processing : ", url)
-			if subLoc.Tingkat == 4 {
-				err = fetchAndStoreTPS(ctx, strings.TrimRight(url, ".json")+"/", subLoc, dataChannel)
+			// Local to this goroutine, siblings run concurrently
+			var err error
+			if subLoc.Tingkat == leafTingkat {
+				err = fetchAndStoreTPS(ctx, childURL, subLoc, path, dataChannel)
 			} else {
-				err = processAndStoreLocation(ctx, strings.TrimRight(url, ".json")+"/", subLoc, dataChannel)
+				err = processAndStoreLocation(ctx, childURL, subLoc, path, dataChannel)
 			}
 			if err != nil {
-				fmt.Println("Error processing and storing sub-location:", err)
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
 			}
-		}(subLoc)
+		})
 	}
 	wg.Wait()
 
+	return errors.Join(errs...)
+}
+
+// Every location that is fetched should have children, the crawl stops at MAX_TINGKAT before fetching
+// the lowest level. An empty or null list means KPU is missing data, so flag it instead of moving on silently.
+func warnIfEmpty(url string, subLocations []Location) {
+	if len(subLocations) > 0 {
+		return
+	}
+	emptyLocations.Add(1)
+	if subLocations == nil {
+		fmt.Println("Warning: null location list :", url)
+		return
+	}
+	fmt.Println("Warning: empty location list :", url)
+}
+
+// Tingkat whose children are the individual TPS, the villages in 2024. Configured in main with LEAF_TINGKAT
+// for elections or future KPU trees where the TPS hang at another level.
+var leafTingkat = 4
+
+// Deepest tingkat to crawl, below leafTingkat only the hierarchy is stored and no TPS are fetched
+var (
+	maxTingkat     = leafTingkat
+	locationStorer LocationStorer
+)
+
+// Store a location with its path when the sink can store the hierarchy
+func storeLocation(ctx context.Context, loc Location, path []PathEntry) error {
+	if locationStorer == nil {
+		return nil
+	}
+	err := locationStorer.StoreLocation(ctx, loc, path)
+	if err != nil {
+		fmt.Println("Error storing location:", loc.Kode, err)
+		return fmt.Errorf("location %s: %w", loc.Kode, err)
+	}
 	return nil
 }
+
+// Stop the crawl after this many TPS, 0 means no limit
+var (
+	maxTPS      int64
+	tpsEnqueued atomic.Int64
+)
+
+// Claim one of the MAX_TPS slots for a TPS about to be enqueued, false once they're all taken
+func claimTPS() bool {
+	if maxTPS <= 0 {
+		return true
+	}
+	return tpsEnqueued.Add(1) <= maxTPS
+}
+
+// Once reached, no more locations are walked, TPS already enqueued still finish and get stored
+func tpsLimitReached() bool {
+	return maxTPS > 0 && tpsEnqueued.Load() >= maxTPS
+}
+
+// Maximum number of ancestors a location crawled by processAndStoreLocation can have
+var maxDepth = 6
+
+// Locations crawled at once at each depth of the hierarchy, so memory stays bounded instead of the whole tree
+// being expanded at once. A location holds its slot while waiting for its children, which take slots one level
+// deeper, so slots are always taken in the same order and can't deadlock. Nil means no limit.
+var levelSlots []chan struct{}
+
+func initLevelSlots(n int) {
+	levelSlots = make([]chan struct{}, maxDepth+1)
+	for i := range levelSlots {
+		levelSlots[i] = make(chan struct{}, n)
+	}
+}
+
+// Wait for a slot at depth, false when ctx is done first
+func acquireLevel(ctx context.Context, depth int) bool {
+	if depth >= len(levelSlots) {
+		return true
+	}
+	select {
+	case levelSlots[depth] <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func releaseLevel(depth int) {
+	if depth >= len(levelSlots) {
+		return
+	}
+	<-levelSlots[depth]
+}
+
+// Only crawl locations under this Kode prefix, empty means everything
+var filterKode string
+
+// A location is crawled when it's inside the filtered region or one of its ancestors
+func matchesFilter(kode string) bool {
+	return strings.HasPrefix(kode, filterKode) || strings.HasPrefix(filterKode, kode)
+}
+
+// Skip every location that sorts before this Kode, a cheap way to restart a crashed crawl near where it stopped
+var resumeFrom string
+
+// Compare at the depth of the shorter Kode, so ancestors of the resume point are still crawled
+func beforeResumePoint(kode string) bool {
+	n := min(len(kode), len(resumeFrom))
+	return kode[:n] < resumeFrom[:n]
+}
+
+// Whether the resume point lies strictly inside kode, meaning part of it was skipped
+func resumesInside(kode string) bool {
+	return len(resumeFrom) > len(kode) && strings.HasPrefix(resumeFrom, kode)
+}
+
+// Crawl children in Kode order so RESUME_FROM picks up roughly where the previous run stopped
+func sortByKode(locations []Location) {
+	sort.Slice(locations, func(i, j int) bool { return locations[i].Kode < locations[j].Kode })
+}
+
+// Count the individual failures inside a tree of joined errors
+func countErrors(err error) int {
+	if err == nil {
+		return 0
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		n := 0
+		for _, e := range joined.Unwrap() {
+			n += countErrors(e)
+		}
+		return n
+	}
+	return 1
+}
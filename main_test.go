@@ -0,0 +1,1016 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/time/rate"
+)
+
+// Serve canned KPU responses keyed by request path and point the crawler at the server.
+// The returned function lists the paths requested so far.
+func newTestServer(t *testing.T, responses map[string]string) func() []string {
+	t.Helper()
+
+	var mu sync.Mutex
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	oldClient, oldBaseURL, oldTPSBaseURL, oldConcurrency, oldSem, oldLimiter := httpClient, baseURL, tpsBaseURL, concurrency, fetchSem, limiter
+	oldCheckpointFile, oldCompleted, oldLevelSlots, oldLeafTingkat, oldMaxTingkat := checkpointFile, completed, levelSlots, leafTingkat, maxTingkat
+	t.Cleanup(func() {
+		httpClient, baseURL, tpsBaseURL, concurrency, fetchSem, limiter = oldClient, oldBaseURL, oldTPSBaseURL, oldConcurrency, oldSem, oldLimiter
+		checkpointFile, completed, levelSlots, leafTingkat, maxTingkat = oldCheckpointFile, oldCompleted, oldLevelSlots, oldLeafTingkat, oldMaxTingkat
+	})
+
+	httpClient = server.Client()
+	baseURL = server.URL + "/wilayah/pemilu/ppwp/"
+	tpsBaseURL = server.URL + "/pemilu/hhcw/ppwp/"
+	concurrency = 2
+	fetchSem = make(chan struct{}, concurrency)
+	limiter = rate.NewLimiter(rate.Inf, 1)
+	checkpointFile = filepath.Join(t.TempDir(), "checkpoints.json")
+	completed = map[string]bool{}
+	seenTPS = newSeenSet()
+	// A single location per level still has to get through the whole hierarchy
+	initLevelSlots(1)
+
+	stopWorkers := startTPSWorkers(context.Background(), concurrency)
+	t.Cleanup(stopWorkers)
+
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), requested...)
+	}
+}
+
+// Run fn with a data channel and return everything sent on it, sorted by id
+func collectTPS(t *testing.T, fn func(dataChannel chan TPSData) error) []TPSData {
+	t.Helper()
+
+	dataChannel := make(chan TPSData, 100)
+	err := fn(dataChannel)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	close(dataChannel)
+
+	var stored []TPSData
+	for data := range dataChannel {
+		stored = append(stored, data)
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Id < stored[j].Id })
+	return stored
+}
+
+const (
+	tpsCounted    = `{"chart":{"100025":10,"100026":20},"administrasi":{"suara_sah":30,"suara_tidak_sah":2,"suara_total":32},"status_suara":true,"status_adm":true}`
+	tpsNotCounted = `{"chart":null,"administrasi":null,"status_suara":false,"status_adm":false}`
+)
+
+// A province down to two TPS in a single village
+var hierarchy = map[string]string{
+	"/wilayah/pemilu/ppwp/11.json":                                   `[{"nama":"KAB. ACEH SELATAN","id":1,"kode":"1101","tingkat":2}]`,
+	"/wilayah/pemilu/ppwp/11/1101.json":                              `[{"nama":"BAKONGAN","id":2,"kode":"110101","tingkat":3}]`,
+	"/wilayah/pemilu/ppwp/11/1101/110101.json":                       `[{"nama":"KEUDE BAKONGAN","id":3,"kode":"1101012001","tingkat":4}]`,
+	"/wilayah/pemilu/ppwp/11/1101/110101/1101012001.json":            `[{"nama":"TPS 001","id":4,"kode":"1101012001001","tingkat":5},{"nama":"TPS 002","id":5,"kode":"1101012001002","tingkat":5}]`,
+	"/pemilu/hhcw/ppwp/11/1101/110101/1101012001/1101012001001.json": tpsCounted,
+	"/pemilu/hhcw/ppwp/11/1101/110101/1101012001/1101012001002.json": tpsCounted,
+}
+
+func TestProcessAndStoreLocationCrawlsHierarchy(t *testing.T) {
+	newTestServer(t, hierarchy)
+
+	province := Location{Nama: "ACEH", ID: 0, Kode: "11", Tingkat: 1}
+	stored := collectTPS(t, func(dataChannel chan TPSData) error {
+		return processAndStoreLocation(context.Background(), baseURL, province, nil, dataChannel)
+	})
+
+	if len(stored) != 2 {
+		t.Fatalf("expected 2 TPS, got %d", len(stored))
+	}
+	if stored[0].Id != 1101012001001 || stored[1].Id != 1101012001002 {
+		t.Errorf("unexpected ids %d, %d", stored[0].Id, stored[1].Id)
+	}
+	if stored[0].Chart["100026"] != 20 || stored[0].Administrasi.SuaraTotal != 32 {
+		t.Errorf("TPS data not parsed: %+v", stored[0])
+	}
+
+	var kodes []string
+	for _, entry := range stored[0].Path {
+		kodes = append(kodes, entry.Kode)
+	}
+	want := []string{"11", "1101", "110101", "1101012001", "1101012001001"}
+	if len(kodes) != len(want) {
+		t.Fatalf("expected path %v, got %v", want, kodes)
+	}
+	for i := range want {
+		if kodes[i] != want[i] {
+			t.Fatalf("expected path %v, got %v", want, kodes)
+		}
+	}
+}
+
+func TestProcessAndStoreLocationFetchesTPSBelowLeafTingkat(t *testing.T) {
+	requested := newTestServer(t, hierarchy)
+
+	district := Location{Nama: "BAKONGAN", ID: 2, Kode: "110101", Tingkat: 3}
+	stored := collectTPS(t, func(dataChannel chan TPSData) error {
+		return processAndStoreLocation(context.Background(), baseURL+"11/1101/", district, nil, dataChannel)
+	})
+
+	if len(stored) != 2 {
+		t.Fatalf("expected 2 TPS, got %d", len(stored))
+	}
+
+	// The village is listed from the wilayah tree, only its TPS come from hhcw
+	paths := requested()
+	sort.Strings(paths)
+	want := []string{
+		"/pemilu/hhcw/ppwp/11/1101/110101/1101012001/1101012001001.json",
+		"/pemilu/hhcw/ppwp/11/1101/110101/1101012001/1101012001002.json",
+		"/wilayah/pemilu/ppwp/11/1101/110101.json",
+		"/wilayah/pemilu/ppwp/11/1101/110101/1101012001.json",
+	}
+	if len(paths) != len(want) {
+		t.Fatalf("expected requests %v, got %v", want, paths)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Fatalf("expected requests %v, got %v", want, paths)
+		}
+	}
+}
+
+func TestProcessAndStoreLocationUsesLeafTingkat(t *testing.T) {
+	// A tree one level shallower, the districts list the TPS directly
+	responses := map[string]string{
+		"/wilayah/pemilu/ppwp/11.json":                     `[{"nama":"KAB. ACEH SELATAN","id":1,"kode":"1101","tingkat":2}]`,
+		"/wilayah/pemilu/ppwp/11/1101.json":                `[{"nama":"BAKONGAN","id":2,"kode":"110101","tingkat":3}]`,
+		"/wilayah/pemilu/ppwp/11/1101/110101.json":         `[{"nama":"TPS 001","id":3,"kode":"1101012001","tingkat":4},{"nama":"TPS 002","id":4,"kode":"1101012002","tingkat":4}]`,
+		"/pemilu/hhcw/ppwp/11/1101/110101/1101012001.json": tpsCounted,
+		"/pemilu/hhcw/ppwp/11/1101/110101/1101012002.json": tpsCounted,
+	}
+	requested := newTestServer(t, responses)
+	leafTingkat = 3
+	maxTingkat = 3
+
+	province := Location{Nama: "ACEH", ID: 0, Kode: "11", Tingkat: 1}
+	stored := collectTPS(t, func(dataChannel chan TPSData) error {
+		return processAndStoreLocation(context.Background(), baseURL, province, nil, dataChannel)
+	})
+
+	if len(stored) != 2 {
+		t.Fatalf("expected 2 TPS, got %d", len(stored))
+	}
+	if stored[0].Id != 1101012001 || stored[1].Id != 1101012002 {
+		t.Errorf("unexpected ids %d, %d", stored[0].Id, stored[1].Id)
+	}
+	for _, path := range requested() {
+		if strings.HasPrefix(path, "/wilayah/pemilu/ppwp/11/1101/110101/") {
+			t.Errorf("crawled below the leaf tingkat: %s", path)
+		}
+	}
+}
+
+func TestCountTPSOnlyListsTPS(t *testing.T) {
+	responses := map[string]string{
+		"/wilayah/pemilu/ppwp/0.json":                         `[{"nama":"ACEH","id":1,"kode":"11","tingkat":1},{"nama":"BALI","id":2,"kode":"51","tingkat":1}]`,
+		"/wilayah/pemilu/ppwp/11.json":                        `[{"nama":"KAB. ACEH SELATAN","id":3,"kode":"1101","tingkat":2}]`,
+		"/wilayah/pemilu/ppwp/11/1101.json":                   `[{"nama":"BAKONGAN","id":4,"kode":"110101","tingkat":3}]`,
+		"/wilayah/pemilu/ppwp/11/1101/110101.json":            `[{"nama":"KEUDE BAKONGAN","id":5,"kode":"1101012001","tingkat":4}]`,
+		"/wilayah/pemilu/ppwp/11/1101/110101/1101012001.json": `[{"nama":"TPS 001","id":6,"kode":"1101012001001","tingkat":5},{"nama":"TPS 002","id":7,"kode":"1101012001002","tingkat":5}]`,
+		"/wilayah/pemilu/ppwp/51.json":                        `[]`,
+	}
+	requested := newTestServer(t, responses)
+	t.Cleanup(func() {
+		countOnly = false
+		tpsPerProvince = map[string]*atomic.Int64{}
+	})
+
+	err := countTPS(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := tpsPerProvince["11"].Load(); n != 2 {
+		t.Errorf("expected 2 TPS in 11, got %d", n)
+	}
+	if n := tpsPerProvince["51"].Load(); n != 0 {
+		t.Errorf("expected no TPS in 51, got %d", n)
+	}
+	for _, path := range requested() {
+		if strings.HasPrefix(path, "/pemilu/hhcw/") {
+			t.Errorf("fetched TPS data while counting: %s", path)
+		}
+	}
+}
+
+func TestFetchAndStoreTPSSkipsUncountedTPS(t *testing.T) {
+	responses := map[string]string{
+		"/wilayah/pemilu/ppwp/11/1101/110101/1101012001.json":            `[{"nama":"TPS 001","id":4,"kode":"1101012001001","tingkat":5},{"nama":"TPS 002","id":5,"kode":"1101012001002","tingkat":5}]`,
+		"/pemilu/hhcw/ppwp/11/1101/110101/1101012001/1101012001001.json": tpsCounted,
+		"/pemilu/hhcw/ppwp/11/1101/110101/1101012001/1101012001002.json": tpsNotCounted,
+	}
+	newTestServer(t, responses)
+
+	village := Location{Nama: "KEUDE BAKONGAN", ID: 3, Kode: "1101012001", Tingkat: 4}
+	stored := collectTPS(t, func(dataChannel chan TPSData) error {
+		return fetchAndStoreTPS(context.Background(), baseURL+"11/1101/110101/", village, nil, dataChannel)
+	})
+
+	if len(stored) != 1 {
+		t.Fatalf("expected 1 TPS, got %d", len(stored))
+	}
+	if stored[0].Id != 1101012001001 {
+		t.Errorf("expected the counted TPS to be stored, got %d", stored[0].Id)
+	}
+}
+
+func TestFetchAndStoreTPSFiltersOnStatus(t *testing.T) {
+	const tpsPath = "/pemilu/hhcw/ppwp/11/1101/110101/1101012001/1101012001001.json"
+	tps := func(statusSuara, statusAdm bool) string {
+		return fmt.Sprintf(`{"chart":{"100025":10},"administrasi":{"suara_sah":10,"suara_total":10},"status_suara":%t,"status_adm":%t}`, statusSuara, statusAdm)
+	}
+
+	tests := []struct {
+		name        string
+		filter      string
+		response    string // empty when the TPS is missing
+		stored      bool
+		expectError bool
+	}{
+		{name: "counted", filter: storeSuara, response: tps(true, true), stored: true},
+		{name: "suara only", filter: storeSuara, response: tps(true, false), stored: true},
+		{name: "adm only", filter: storeSuara, response: tps(false, true)},
+		{name: "neither", filter: storeSuara, response: tps(false, false)},
+		{name: "adm filter", filter: storeAdm, response: tps(false, true), stored: true},
+		{name: "adm filter without adm", filter: storeAdm, response: tps(true, false)},
+		{name: "either filter", filter: storeEither, response: tps(false, true), stored: true},
+		{name: "all filter", filter: storeAll, response: tps(false, false), stored: true},
+		{name: "fetch error", filter: storeSuara, expectError: true},
+		{name: "fetch error with all filter", filter: storeAll, expectError: true},
+		{name: "malformed response", filter: storeAll, response: `{"chart":`, expectError: true},
+		{name: "partially decoded response", filter: storeSuara, response: `{"status_suara":true,"administrasi":{"suara_sah":"ten"}}`, expectError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses := map[string]string{
+				"/wilayah/pemilu/ppwp/11/1101/110101/1101012001.json": `[{"nama":"TPS 001","id":4,"kode":"1101012001001","tingkat":5}]`,
+			}
+			if tt.response != "" {
+				responses[tpsPath] = tt.response
+			}
+			newTestServer(t, responses)
+			oldFilter := storeFilter
+			t.Cleanup(func() { storeFilter = oldFilter })
+			storeFilter = tt.filter
+
+			village := Location{Nama: "KEUDE BAKONGAN", ID: 3, Kode: "1101012001", Tingkat: 4}
+			dataChannel := make(chan TPSData, 10)
+			err := fetchAndStoreTPS(context.Background(), baseURL+"11/1101/110101/", village, nil, dataChannel)
+			close(dataChannel)
+
+			if tt.expectError != (err != nil) {
+				t.Errorf("expected error %t, got %v", tt.expectError, err)
+			}
+			var stored []TPSData
+			for data := range dataChannel {
+				stored = append(stored, data)
+			}
+			if !tt.stored {
+				if len(stored) != 0 {
+					t.Fatalf("expected nothing stored, got %+v", stored)
+				}
+				return
+			}
+			if len(stored) != 1 {
+				t.Fatalf("expected 1 TPS, got %d", len(stored))
+			}
+			if stored[0].Id != 1101012001001 {
+				t.Errorf("expected TPS 1101012001001, got %d", stored[0].Id)
+			}
+		})
+	}
+}
+
+func TestProcessAndStoreLocationCollectsEverySiblingError(t *testing.T) {
+	responses := map[string]string{
+		"/wilayah/pemilu/ppwp/11/1101/110101.json": `[
+			{"nama":"A","id":1,"kode":"1101012001","tingkat":4},
+			{"nama":"B","id":2,"kode":"1101012002","tingkat":4},
+			{"nama":"C","id":3,"kode":"1101012003","tingkat":4},
+			{"nama":"D","id":4,"kode":"1101012004","tingkat":4}
+		]`,
+		"/wilayah/pemilu/ppwp/11/1101/110101/1101012001.json":            `[{"nama":"TPS 001","id":5,"kode":"1101012001001","tingkat":5}]`,
+		"/wilayah/pemilu/ppwp/11/1101/110101/1101012003.json":            `[{"nama":"TPS 001","id":6,"kode":"1101012003001","tingkat":5}]`,
+		"/pemilu/hhcw/ppwp/11/1101/110101/1101012001/1101012001001.json": tpsCounted,
+		"/pemilu/hhcw/ppwp/11/1101/110101/1101012003/1101012003001.json": tpsCounted,
+	}
+	newTestServer(t, responses)
+
+	// Villages B and D are missing, both failures must be reported whatever order the goroutines finish in
+	district := Location{Nama: "BAKONGAN", ID: 2, Kode: "110101", Tingkat: 3}
+	dataChannel := make(chan TPSData, 10)
+	err := processAndStoreLocation(context.Background(), baseURL+"11/1101/", district, nil, dataChannel)
+	close(dataChannel)
+
+	if n := countErrors(err); n != 2 {
+		t.Errorf("expected 2 failures, got %d: %v", n, err)
+	}
+	if n := len(dataChannel); n != 2 {
+		t.Errorf("expected 2 TPS from the other villages, got %d", n)
+	}
+}
+
+// Run tasks through a LimitedWaitGroup and return the most that ran at once
+func runLimited(limit int, tasks int, task func()) int64 {
+	var running, peak atomic.Int64
+	wg := NewLimitedWaitGroup(limit)
+	for i := 0; i < tasks; i++ {
+		wg.Go(func() {
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			task()
+			running.Add(-1)
+		})
+	}
+	wg.Wait()
+	return peak.Load()
+}
+
+func TestLimitedWaitGroupRunsEveryTaskWithLimitOne(t *testing.T) {
+	var done atomic.Int64
+	peak := runLimited(1, 1000, func() { done.Add(1) })
+	if done.Load() != 1000 {
+		t.Errorf("%d tasks ran, want 1000", done.Load())
+	}
+	if peak != 1 {
+		t.Errorf("%d tasks ran at once, want 1", peak)
+	}
+}
+
+func TestLimitedWaitGroupStaysWithinLimit(t *testing.T) {
+	peak := runLimited(3, 200, func() { time.Sleep(time.Millisecond) })
+	if peak > 3 {
+		t.Errorf("%d tasks ran at once, want at most 3", peak)
+	}
+}
+
+func TestLimitedWaitGroupWaitBlocksUntilTasksReturn(t *testing.T) {
+	release := make(chan struct{})
+	var done atomic.Int64
+	wg := NewLimitedWaitGroup(2)
+	for i := 0; i < 5; i++ {
+		wg.Go(func() {
+			<-release
+			done.Add(1)
+		})
+	}
+
+	returned := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+		t.Fatal("Wait returned while tasks were still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't return once the tasks did")
+	}
+	if done.Load() != 5 {
+		t.Errorf("Wait returned after %d tasks, want 5", done.Load())
+	}
+}
+
+func TestLimitedWaitGroupLimitBelowOneRunsOneAtATime(t *testing.T) {
+	// Go has no Add to misuse, a limit below one is the only invalid input and is raised to one
+	for _, limit := range []int{0, -1} {
+		peak := runLimited(limit, 50, func() { time.Sleep(time.Millisecond) })
+		if peak != 1 {
+			t.Errorf("limit %d: %d tasks ran at once, want 1", limit, peak)
+		}
+	}
+}
+
+func TestLimitedWaitGroupGoDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	wg := NewLimitedWaitGroup(1)
+
+	// Every slot is taken by a task that won't finish until released, starting more must still return
+	started := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			wg.Go(func() { <-release })
+		}
+		close(started)
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Go blocked while the limit was reached")
+	}
+
+	close(release)
+	wg.Wait()
+}
+
+func TestLimitedWaitGroupGoWhenFreeBlocksUntilASlotIsFree(t *testing.T) {
+	release := make(chan struct{})
+	wg := NewLimitedWaitGroup(2)
+	for i := 0; i < 2; i++ {
+		wg.GoWhenFree(func() { <-release })
+	}
+
+	started := make(chan struct{})
+	go func() {
+		wg.GoWhenFree(func() {})
+		close(started)
+	}()
+	select {
+	case <-started:
+		t.Fatal("GoWhenFree returned while every slot was taken")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("GoWhenFree didn't return once a slot was free")
+	}
+	wg.Wait()
+}
+
+func TestLimitedWaitGroupTasksCanStartTasks(t *testing.T) {
+	var done atomic.Int64
+	wg := NewLimitedWaitGroup(1)
+	for i := 0; i < 10; i++ {
+		wg.Go(func() {
+			for j := 0; j < 10; j++ {
+				wg.Go(func() { done.Add(1) })
+			}
+		})
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlocked")
+	}
+	if done.Load() != 100 {
+		t.Errorf("%d nested tasks ran, want 100", done.Load())
+	}
+}
+
+func TestStaleTrackerFlagsTPSBehindTheirVillage(t *testing.T) {
+	tracker := newStaleTracker()
+	start := time.Date(2024, 2, 14, 20, 0, 0, 0, wib)
+	stuck := TPSData{Id: 1101012001001, Timestamp: start}
+	moving := TPSData{Id: 1101012001002, Timestamp: start}
+	alone := TPSData{Id: 1101012002001, Timestamp: start}
+
+	var flagged []bool
+	for cycle := 1; cycle <= 4; cycle++ {
+		tracker.nextCycle()
+		moving.Timestamp = start.Add(time.Duration(cycle) * time.Hour)
+		flagged = []bool{
+			tracker.observe(stuck, "1101012001"),
+			tracker.observe(moving, "1101012001"),
+			tracker.observe(alone, "1101012002"),
+		}
+		if cycle < 4 && flagged[0] {
+			t.Errorf("flagged as stale after %d cycles", cycle)
+		}
+	}
+	if !flagged[0] {
+		t.Error("TPS unchanged while its village moved isn't flagged")
+	}
+	if flagged[1] {
+		t.Error("TPS that keeps updating is flagged")
+	}
+	if flagged[2] {
+		t.Error("TPS in a village that didn't move is flagged")
+	}
+
+	stuck.StatusSuara = true
+	tracker.nextCycle()
+	if tracker.observe(stuck, "1101012001") {
+		t.Error("counted TPS is flagged")
+	}
+}
+
+func TestStoredFieldsProjection(t *testing.T) {
+	fields, err := parseFields("chart, administrasi.suara_total, status_suara")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	old := storedFields
+	t.Cleanup(func() { storedFields = old })
+	storedFields = fields
+
+	data := TPSData{
+		Id:           1101012001001,
+		Mode:         "hitung",
+		Chart:        Chart{"100025": 10},
+		Administrasi: Administrasi{SuaraSah: 10, SuaraTotal: 12},
+		StatusSuara:  true,
+	}
+
+	object, err := storedFields.object(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := json.Marshal(object)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `{"administrasi":{"suara_total":12},"chart":{"100025":10},"id":1101012001001,"status_suara":true}`
+	if string(b) != want {
+		t.Errorf("JSON %s, want %s", b, want)
+	}
+
+	document, err := storedFields.document(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var doc bson.M
+	err = bson.Unmarshal(raw, &doc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(doc) != 4 || doc["statussuara"] != true || fmt.Sprint(doc["administrasi"]) != "map[suaratotal:12]" {
+		t.Errorf("unexpected BSON %v", doc)
+	}
+
+	// Only the sinks project, anything else still sees the whole TPS
+	b, err = json.Marshal(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(b), `"mode":"hitung"`) {
+		t.Errorf("plain JSON was projected: %s", b)
+	}
+
+	_, err = parseFields("chart,administrasi.nope")
+	if err == nil {
+		t.Error("unknown field accepted")
+	}
+}
+
+func TestReplayParsesRawResponses(t *testing.T) {
+	dir := t.TempDir()
+	raw, err := gzipBytes([]byte(`{"chart":{"100025":10,"100026":20},"administrasi":{"suara_sah":40,"suara_tidak_sah":2,"suara_total":42},"status_suara":true,"status_adm":true}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "1101012001001.json.gz"), raw, 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "1101012001002.json.gz"), []byte("not gzip"), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	oldConfig, oldRawDir := config, rawDir
+	t.Cleanup(func() { config, rawDir = oldConfig, oldRawDir })
+	rawDir = dir
+	config.StorageBackend = "jsonl"
+	config.OutputPath = filepath.Join(t.TempDir(), "replayed.jsonl")
+
+	err = replay(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, err := os.ReadFile(config.OutputPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 replayed TPS, got %d", len(lines))
+	}
+	var data TPSData
+	err = json.Unmarshal([]byte(lines[0]), &data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data.Id != 1101012001001 {
+		t.Errorf("unexpected id %d", data.Id)
+	}
+	// The chart adds up to 30 of 40 valid votes
+	if len(data.Anomalies) == 0 {
+		t.Error("replayed TPS wasn't validated")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 2, 15, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"Thu, 15 Feb 2024 10:00:30 GMT", 30 * time.Second},
+		{"Thu, 15 Feb 2024 09:00:00 GMT", 0},
+		{"86400", maxRetryAfter},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFetchWaitsForRetryAfter(t *testing.T) {
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	t.Cleanup(server.Close)
+	newTestServer(t, nil)
+	httpClient = server.Client()
+	oldDelay := retryDelay
+	t.Cleanup(func() { retryDelay = oldDelay })
+	// Far longer than the test runs, only Retry-After can get the retry in on time
+	retryDelay = time.Hour
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	attempts, err := withRetry(ctx, func() error {
+		_, err := fetchLocations(ctx, server.URL+"/0.json")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error after %d attempts: %v", attempts, err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, before Retry-After", elapsed)
+	}
+	if limiter.Limit() == rate.Inf {
+		t.Error("rate limit wasn't lowered")
+	}
+}
+
+func TestBreakerCountsMaintenancePagesAsFailures(t *testing.T) {
+	newTestServer(t, map[string]string{"/wilayah/pemilu/ppwp/0.json": `<html><body>Sedang dalam pemeliharaan</body></html>`})
+	oldBreaker := breaker
+	t.Cleanup(func() { breaker = oldBreaker })
+	breaker = newCircuitBreaker(4, 0.5, time.Hour)
+
+	ctx := context.Background()
+	// Two scans fill half the window, a scan isn't JSON either and mustn't count
+	for i := 0; i < 2; i++ {
+		_, err := httpGet(ctx, baseURL+"0.json")
+		if err != nil {
+			t.Fatalf("httpGet: %v", err)
+		}
+	}
+	if breaker.failures != 0 {
+		t.Errorf("breaker counted %d failures for non JSON fetches", breaker.failures)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := httpGetJSON(ctx, baseURL+"0.json")
+		var notJSONErr *NotJSONError
+		if !errors.As(err, &notJSONErr) {
+			t.Fatalf("httpGetJSON = %v, want a NotJSONError", err)
+		}
+	}
+	if !breaker.openUntil.After(time.Now()) {
+		t.Error("breaker didn't open after the maintenance pages")
+	}
+}
+
+func TestLocationLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newLocationLRU(2)
+	cache.add("a", []Location{{Kode: "11"}})
+	cache.add("b", []Location{{Kode: "12"}})
+	if _, ok := cache.get("a"); !ok {
+		t.Fatal("a wasn't cached")
+	}
+	cache.add("c", []Location{{Kode: "13"}})
+	if _, ok := cache.get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+	locations, ok := cache.get("a")
+	if !ok || locations[0].Kode != "11" {
+		t.Fatalf("unexpected a: %v %v", locations, ok)
+	}
+	// Callers sort their lists in place, that mustn't reach the cache
+	locations[0].Kode = "99"
+	if locations, _ := cache.get("a"); locations[0].Kode != "11" {
+		t.Errorf("cached list was changed to %v", locations)
+	}
+}
+
+func TestProvinceSinkWritesAFilePerProvince(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data_tps.jsonl")
+	// One open file at a time, every province switch closes one and appends to it later
+	sink := NewProvinceSink(path, 1, func(path string, appending bool) (Sink, error) {
+		return openJSONLSink(path, appending)
+	})
+	ctx := context.Background()
+	for _, id := range []int64{1101012001001, 1201012001001, 1101012001002, 1201012001002, 1101012001003} {
+		err := sink.Store(ctx, TPSData{Id: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for province, want := range map[string]int{"11": 3, "12": 2} {
+		body, err := os.ReadFile(provincePath(path, province))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(body), "\n"); lines != want {
+			t.Errorf("province %s: expected %d TPS, got %d", province, want, lines)
+		}
+	}
+}
+
+func TestS3UploadSkipsExistingKeys(t *testing.T) {
+	requested := newTestServer(t, map[string]string{"/wilayah/pemilu/ppwp/scan.jpg": "scan"})
+	var mu sync.Mutex
+	objects := map[string]string{}
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodHead:
+			if _, ok := objects[r.URL.Path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = string(body)
+		}
+	}))
+	t.Cleanup(bucket.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	store, err := newS3ImageStore(context.Background(), "scans", "2024/", bucket.URL, "us-east-1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStore, oldDownload := imageStore, downloadImages
+	t.Cleanup(func() { imageStore, downloadImages = oldStore, oldDownload })
+	imageStore, downloadImages = store, true
+
+	data := TPSData{Id: 1101012001001, Images: []string{baseURL + "scan.jpg", ""}}
+	for i := 0; i < 2; i++ {
+		keys := processImages(context.Background(), data).ImageKeys
+		if len(keys) != 1 || keys[0] != "2024/1101012001001/scan.jpg" {
+			t.Fatalf("unexpected keys %v", keys)
+		}
+	}
+	if body := objects["/scans/2024/1101012001001/scan.jpg"]; body != "scan" {
+		t.Errorf("expected the scan in the bucket, got %q from %v", body, objects)
+	}
+	// The second run found the key and didn't fetch the scan again
+	if n := len(requested()); n != 1 {
+		t.Errorf("expected the scan to be fetched once, got %d", n)
+	}
+}
+
+func TestThrottleHalvesOnceAndRecoversToUnlimited(t *testing.T) {
+	oldLimiter, oldMax, oldConcurrency := limiter, maxRateLimit, concurrency
+	oldSlowdown, oldUntil, oldFrom := lastSlowdown, throttledUntil, throttledFrom
+	t.Cleanup(func() {
+		limiter, maxRateLimit, concurrency = oldLimiter, oldMax, oldConcurrency
+		lastSlowdown, throttledUntil, throttledFrom = oldSlowdown, oldUntil, oldFrom
+	})
+	limiter, maxRateLimit, concurrency = rate.NewLimiter(rate.Inf, 1), rate.Inf, 8
+	lastSlowdown, throttledUntil, throttledFrom = time.Time{}, time.Time{}, 0
+
+	// A burst of 429s only counts once
+	for i := 0; i < 5; i++ {
+		throttle(time.Hour)
+	}
+	if limiter.Limit() != 4 {
+		t.Fatalf("expected the rate halved once to 4, got %v", limiter.Limit())
+	}
+	relieveBackpressure()
+	if limiter.Limit() != 4 {
+		t.Errorf("rate raised to %v before Retry-After", limiter.Limit())
+	}
+
+	throttledUntil = time.Now()
+	for i := 0; i < 20 && limiter.Limit() != rate.Inf; i++ {
+		relieveBackpressure()
+	}
+	if limiter.Limit() != rate.Inf {
+		t.Errorf("expected the rate back to unlimited, got %v", limiter.Limit())
+	}
+}
+
+func TestRecheckUpdateKeepsWhatTheCrawlAttached(t *testing.T) {
+	data := TPSData{Id: 1101012001001, Chart: Chart{"100025": 10}, StatusSuara: true, Stale: true, Path: []PathEntry{{Kode: "11"}}}
+	update, err := recheckUpdate(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	set, unset := update["$set"].(bson.M), update["$unset"].(bson.M)
+	for _, field := range []string{"chart", "statussuara", "anomalies", "last_updated"} {
+		if _, ok := set[field]; !ok {
+			t.Errorf("%s isn't updated", field)
+		}
+	}
+	for _, field := range []string{"path", "stale", "image_paths", "image_keys", "image_hashes", "image_meta", "raw"} {
+		_, inSet := set[field]
+		_, inUnset := unset[field]
+		if inSet || inUnset {
+			t.Errorf("%s is changed by a recheck", field)
+		}
+	}
+	// Empty now, so what an earlier fetch stored goes
+	if _, ok := unset["votes"]; !ok {
+		t.Error("outdated votes are kept")
+	}
+}
+
+func TestProcessImagesFetchesEachScanOnce(t *testing.T) {
+	requested := newTestServer(t, map[string]string{"/wilayah/pemilu/ppwp/scan.jpg": "scan"})
+	oldDownload, oldHash, oldMeta, oldDir := downloadImages, hashImagesEnabled, imageMetadataEnabled, imageDir
+	t.Cleanup(func() {
+		downloadImages, hashImagesEnabled, imageMetadataEnabled, imageDir = oldDownload, oldHash, oldMeta, oldDir
+	})
+	downloadImages, hashImagesEnabled, imageMetadataEnabled, imageDir = true, true, true, t.TempDir()
+
+	data := processImages(context.Background(), TPSData{
+		Id:     1101012001001,
+		Images: []string{baseURL + "missing.jpg", baseURL + "scan.jpg"},
+	})
+	if n := len(requested()); n != 2 {
+		t.Errorf("expected one request per scan, got %d", n)
+	}
+	// The missing scan is left out of everything instead of stored as an empty entry
+	if len(data.ImagePaths) != 1 || len(data.ImageHashes) != 1 || len(data.ImageMeta) != 1 {
+		t.Fatalf("unexpected paths %v, hashes %v, meta %v", data.ImagePaths, data.ImageHashes, data.ImageMeta)
+	}
+	if data.ImageHashes[0].URL != baseURL+"scan.jpg" || data.ImageMeta[0].Bytes != 4 {
+		t.Errorf("unexpected hash %v, meta %v", data.ImageHashes[0], data.ImageMeta[0])
+	}
+
+	// Documents stored before the url was recorded hold just the hash
+	raw, err := bson.Marshal(bson.M{"image_hashes": bson.A{"abc", bson.M{"url": "a.jpg", "sha256": "def"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored TPSData
+	err = bson.Unmarshal(raw, &stored)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(stored.ImageHashes) != "[{ abc} {a.jpg def}]" {
+		t.Errorf("unexpected hashes %v", stored.ImageHashes)
+	}
+}
+
+// failingSink fails every record, like a full disk or a document Mongo rejects
+type failingSink struct{}
+
+func (failingSink) Store(ctx context.Context, data TPSData) error {
+	return errors.New("disk full")
+}
+
+func (failingSink) Close() error {
+	return nil
+}
+
+func TestSendDataGivesUpOnceAWriterStopped(t *testing.T) {
+	dataChannel := make(chan TPSData)
+	pool := startWriters([]Sink{failingSink{}}, dataChannel)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// The writer takes the first record, fails to store it and exits
+	err := sendData(ctx, dataChannel, TPSData{Id: 1})
+	if err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+	<-pool.stopped
+
+	err = sendData(ctx, dataChannel, TPSData{Id: 2})
+	if !errors.Is(err, errWritersStopped) {
+		t.Errorf("sendData after the writer stopped = %v, want %v", err, errWritersStopped)
+	}
+	if err := pool.wait(); err == nil {
+		t.Error("wait didn't report the store error")
+	}
+}
+
+func TestSQLiteSinkAddsColumnsToEarlierFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data_tps.db")
+	// A file written before percentages, stale and the image columns existed
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(sqliteSchema)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err := NewSQLiteSink(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := TPSData{
+		Id:          1101012001001,
+		Percentages: map[string]float64{"100025": 100},
+		Stale:       true,
+		ImageKeys:   []string{"1101012001001/a.jpg"},
+		ImageMeta:   []ImageMeta{{URL: "https://example.com/a.jpg", Bytes: 20000, Width: 800, Height: 600}},
+	}
+	if err := sink.Store(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var stale bool
+	var percentages, imageKeys, imageMeta string
+	err = db.QueryRow("SELECT stale, percentages, image_keys, image_meta FROM data_tps WHERE id = ?", data.Id).
+		Scan(&stale, &percentages, &imageKeys, &imageMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stale || percentages != `{"100025":100}` || imageKeys != `["1101012001001/a.jpg"]` || !strings.Contains(imageMeta, "a.jpg") {
+		t.Errorf("stored stale %t, percentages %s, image keys %s, image meta %s", stale, percentages, imageKeys, imageMeta)
+	}
+}
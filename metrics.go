@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	fetchesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sipantau_fetches_total",
+		Help: "Number of HTTP requests made to KPU.",
+	})
+	fetchesFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sipantau_fetches_failed_total",
+		Help: "Number of HTTP requests to KPU that failed.",
+	})
+	fetchesInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sipantau_fetches_in_flight",
+		Help: "Number of HTTP requests to KPU currently in flight.",
+	})
+	tpsStored = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sipantau_tps_stored_total",
+		Help: "Number of TPS documents written to the database.",
+	})
+	duplicatesSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sipantau_duplicate_key_skips_total",
+		Help: "Number of TPS documents skipped because of a duplicate key error.",
+	})
+	channelFull = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sipantau_data_channel_full_total",
+		Help: "Number of TPS sends that found the data channel full and had to wait for the writer.",
+	})
+	channelBlockedSeconds = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sipantau_data_channel_blocked_seconds_total",
+		Help: "Time spent waiting for the writer on a full data channel.",
+	})
+	breakerTrips = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sipantau_circuit_breaker_trips_total",
+		Help: "Number of times fetching was paused because too many requests to KPU failed.",
+	})
+	rateLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sipantau_rate_limit_rps",
+		Help: "Current request rate limit, lowered while the writer can't keep up.",
+	})
+)
+
+// Serve the Prometheus /metrics endpoint in the background
+func startMetricsServer(port int) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+		if err != nil {
+			fmt.Println("Error serving metrics:", err)
+		}
+	}()
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// Database and TPS collection names, configured in main so several elections can live side by side
+var (
+	mongoDatabase   = "sipantau"
+	mongoCollection = "data_tps"
+)
+
+// MongoSink upserts TPS data into MongoDB in batches
+type MongoSink struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+	locations  *mongo.Collection
+	failures   *mongo.Collection
+	anomalies  *mongo.Collection
+	images     *mongo.Collection
+	batchSize  int
+	batch      []TPSData
+}
+
+// Connect and ping MongoDB, so a bad MONGO_DB_URL fails before crawling rather than on the first insert.
+// The ping is retried MONGO_CONNECT_RETRIES times, each attempt waiting up to MONGO_CONNECT_TIMEOUT_SECONDS.
+func connectMongo(ctx context.Context, uri string) (*mongo.Client, error) {
+	if uri == "" {
+		return nil, errors.New("failed to connect to MongoDB: MONGO_DB_URL is not set")
+	}
+	opts, err := mongoClientOptions(uri, config.MongoWriteConcern, config.MongoReadPreference)
+	if err != nil {
+		return nil, err
+	}
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+	}
+
+	attempts := config.MongoConnectRetries
+	timeout := config.MongoConnectTimeout
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, timeout)
+		err = client.Ping(pingCtx, nil)
+		cancel()
+		if err == nil {
+			return client, nil
+		}
+
+		fmt.Println("Error pinging MongoDB, attempt", attempt, ":", err)
+		if attempt == attempts {
+			break
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		delay *= 2
+	}
+	client.Disconnect(context.Background())
+	return nil, fmt.Errorf("MongoDB unreachable: %w", err)
+}
+
+// Client options for uri, writeConcern ("majority" or a number of nodes) and readPreference override what the URI says
+func mongoClientOptions(uri, writeConcern, readPreference string) (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(uri)
+	switch writeConcern {
+	case "":
+	case "majority":
+		opts.SetWriteConcern(writeconcern.Majority())
+	default:
+		// Unacknowledged writes would hide every failed insert, so at least one node has to acknowledge
+		w, err := strconv.Atoi(writeConcern)
+		if err != nil || w < 1 {
+			return nil, fmt.Errorf("invalid MONGO_WRITE_CONCERN %q, expected majority or a number of nodes from 1", writeConcern)
+		}
+		opts.SetWriteConcern(&writeconcern.WriteConcern{W: w})
+	}
+	if readPreference != "" {
+		mode, err := readpref.ModeFromString(readPreference)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MONGO_READ_PREFERENCE %q: %w", readPreference, err)
+		}
+		pref, err := readpref.New(mode)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MONGO_READ_PREFERENCE %q: %w", readPreference, err)
+		}
+		opts.SetReadPreference(pref)
+	}
+	return opts, nil
+}
+
+func NewMongoSink(ctx context.Context, uri string) (*MongoSink, error) {
+	client, err := connectMongo(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	// Database & Collection
+	db := client.Database(mongoDatabase)
+	collection := db.Collection(mongoCollection)
+	if atomicRefresh {
+		// Start from an empty collection, whatever is there was left by a refresh that never completed
+		collection = db.Collection(refreshCollection())
+		err = collection.Drop(ctx)
+		if err != nil {
+			client.Disconnect(context.Background())
+			return nil, fmt.Errorf("error dropping %s: %w", refreshCollection(), err)
+		}
+	}
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: -1}},
+		Options: options.Index().SetUnique(true),
+	}
+	err = ensureIndex(ctx, collection, indexModel)
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	// Analysts filter on how the numbers were entered
+	err = ensureIndex(ctx, collection, mongo.IndexModel{Keys: bson.D{{Key: "mode", Value: 1}}})
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	locations := db.Collection("locations")
+	err = ensureIndex(ctx, locations, mongo.IndexModel{
+		Keys:    bson.D{{Key: "kode", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	anomalies := db.Collection("anomalies")
+	if anomalyStorage != anomaliesEmbedded {
+		err = ensureAnomalyEventIndex(ctx, anomalies)
+		if err != nil {
+			client.Disconnect(context.Background())
+			return nil, err
+		}
+	}
+
+	images := db.Collection(imageQueueCollection)
+	if imageQueue {
+		err = ensureIndex(ctx, images, imageQueueIndex)
+		if err != nil {
+			client.Disconnect(context.Background())
+			return nil, err
+		}
+	}
+
+	batchSize := config.MongoBatchSize
+	return &MongoSink{
+		client:     client,
+		collection: collection,
+		locations:  locations,
+		failures:   db.Collection("failed_fetches"),
+		anomalies:  anomalies,
+		images:     images,
+		batchSize:  batchSize,
+		batch:      make([]TPSData, 0, batchSize),
+	}, nil
+}
+
+// Attempts at creating an index before giving up
+const indexAttempts = 5
+
+// Create an index, retrying transient errors. Mongo already treats creating an identical index as a no-op,
+// an existing index on the same keys with different options is kept as is with a warning.
+func ensureIndex(ctx context.Context, collection *mongo.Collection, model mongo.IndexModel) error {
+	delay := time.Second
+	var err error
+	for attempt := 1; attempt <= indexAttempts; attempt++ {
+		_, err = collection.Indexes().CreateOne(ctx, model)
+		if err == nil {
+			return nil
+		}
+
+		// IndexOptionsConflict (85) and IndexKeySpecsConflict (86)
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && (cmdErr.Code == 85 || cmdErr.Code == 86) {
+			fmt.Println("Warning: keeping the existing index on", collection.Name(), ":", err)
+			return nil
+		}
+
+		fmt.Println("Error creating index on", collection.Name(), "attempt", attempt, ":", err)
+		if attempt == indexAttempts {
+			break
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+	return fmt.Errorf("failed to create index on %s: %w", collection.Name(), err)
+}
+
+func (s *MongoSink) Store(ctx context.Context, data TPSData) error {
+	s.batch = append(s.batch, data)
+	if len(s.batch) < s.batchSize {
+		return nil
+	}
+	return s.Flush(ctx)
+}
+
+func (s *MongoSink) Flush(ctx context.Context) error {
+	if anomalyStorage != anomaliesEmbedded {
+		err := storeAnomalyEvents(ctx, s.anomalies, s.batch)
+		if err != nil {
+			return err
+		}
+	}
+	if imageQueue {
+		err := queueImages(ctx, s.images, s.batch)
+		if err != nil {
+			return err
+		}
+	}
+	if anomalyStorage == anomaliesSeparate {
+		for i := range s.batch {
+			s.batch[i].Anomalies = nil
+		}
+	}
+
+	err := writeBatch(ctx, s.collection, s.batch)
+	if err != nil {
+		return err
+	}
+	s.batch = s.batch[:0]
+	return nil
+}
+
+// StoredLocation is a location of the hierarchy as stored in the locations collection,
+// Path runs from the province down to the location itself
+type StoredLocation struct {
+	Location `bson:",inline"`
+	Path     []PathEntry `json:"path" bson:"path"`
+}
+
+// Upsert a location of the administrative hierarchy, safe to call from many goroutines
+func (s *MongoSink) StoreLocation(ctx context.Context, loc Location, path []PathEntry) error {
+	_, err := s.locations.ReplaceOne(ctx, bson.M{"kode": loc.Kode}, StoredLocation{loc, path}, options.Replace().SetUpsert(true))
+	return err
+}
+
+// Stored KPU timestamp of each of the given TPS that is already in the collection
+func (s *MongoSink) StoredTimestamps(ctx context.Context, ids []int64) (map[int64]time.Time, error) {
+	cursor, err := s.collection.Find(ctx,
+		bson.M{"id": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"id": 1, "timestamp": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []TPSData
+	err = cursor.All(ctx, &docs)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make(map[int64]time.Time, len(docs))
+	for _, doc := range docs {
+		stored[doc.Id] = doc.Timestamp
+	}
+	return stored, nil
+}
+
+// Which of the given TPS are already stored with status_suara true
+func (s *MongoSink) CountedTPS(ctx context.Context, ids []int64) (map[int64]bool, error) {
+	cursor, err := s.collection.Find(ctx,
+		bson.M{"id": bson.M{"$in": ids}, "statussuara": true},
+		options.Find().SetProjection(bson.M{"id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []TPSData
+	err = cursor.All(ctx, &docs)
+	if err != nil {
+		return nil, err
+	}
+
+	counted := make(map[int64]bool, len(docs))
+	for _, doc := range docs {
+		counted[doc.Id] = true
+	}
+	return counted, nil
+}
+
+// Record a permanently failed fetch in the failed_fetches collection
+func (s *MongoSink) StoreFailure(ctx context.Context, failure FailedFetch) error {
+	_, err := s.failures.InsertOne(ctx, failure)
+	return err
+}
+
+// Flush whatever is left in the batch and disconnect
+func (s *MongoSink) Close() error {
+	err := s.Flush(context.Background())
+	s.client.Disconnect(context.Background())
+	return err
+}
+
+// Writer returns a sink with a batch of its own on the same connection, so several insertData goroutines
+// can write at once. Concurrent upserts of the same id are caught by the unique index and skipped in flushBatch.
+func (s *MongoSink) Writer() Sink {
+	return mongoWriter{&MongoSink{
+		collection: s.collection,
+		anomalies:  s.anomalies,
+		images:     s.images,
+		batchSize:  s.batchSize,
+		batch:      make([]TPSData, 0, s.batchSize),
+	}}
+}
+
+// mongoWriter only flushes on Close, the connection is closed with the MongoSink it came from
+type mongoWriter struct {
+	*MongoSink
+}
+
+func (w mongoWriter) Close() error {
+	return w.Flush(context.Background())
+}
+
+// Retries of a batch that failed to write, and where batches that still fail are set aside, configured in main
+var (
+	mongoWriteRetries = 3
+	failedBatchesPath = "failed_batches.jsonl"
+)
+
+// Write a batch, retrying timeouts and network errors with exponential backoff. Every document is an upsert on id,
+// so writing a partly written batch again can't duplicate anything. A batch that still times out is appended to
+// failedBatchesPath instead, so one database hiccup doesn't stop the writer and lose everything buffered behind it.
+// Any other error, like a failed authentication or a rejected document, won't go away on its own and is returned.
+func writeBatch(ctx context.Context, collection *mongo.Collection, batch []TPSData) error {
+	delay := time.Second
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = flushBatch(ctx, collection, batch)
+		if err == nil {
+			return nil
+		}
+		if !isTransientMongoError(err) {
+			return err
+		}
+		if attempt > mongoWriteRetries || ctx.Err() != nil {
+			break
+		}
+		fmt.Println("Error writing batch, attempt", attempt, ":", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		delay *= 2
+	}
+
+	saveErr := saveFailedBatch(failedBatchesPath, batch)
+	if saveErr != nil {
+		return errors.Join(err, fmt.Errorf("error saving failed batch: %w", saveErr))
+	}
+	failedBatches.Add(1)
+	fmt.Println("Giving up on a batch of", len(batch), "TPS, saved to", failedBatchesPath, ":", err)
+	return nil
+}
+
+// Errors worth writing the batch again for
+func isTransientMongoError(err error) bool {
+	var labeled mongo.LabeledError
+	return mongo.IsTimeout(err) || mongo.IsNetworkError(err) ||
+		(errors.As(err, &labeled) && labeled.HasErrorLabel("RetryableWriteError"))
+}
+
+var failedBatchesMu sync.Mutex
+
+// Append a batch as MongoDB extended JSON lines, ready for mongoimport --mode=upsert --upsertFields=id
+func saveFailedBatch(path string, batch []TPSData) error {
+	failedBatchesMu.Lock()
+	defer failedBatchesMu.Unlock()
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	for _, data := range batch {
+		doc, err := storedFields.document(data)
+		var line []byte
+		if err == nil {
+			line, err = bson.MarshalExtJSON(doc, false, false)
+		}
+		if err == nil {
+			_, err = file.Write(append(line, '\n'))
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// Write a batch with an unordered BulkWrite, skipping duplicate key races between concurrent upserts
+func flushBatch(ctx context.Context, collection *mongo.Collection, batch []TPSData) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if hashImagesEnabled {
+		reportReplacedScans(ctx, collection, batch)
+	}
+
+	// Upsert on id so re-runs refresh the numbers as KPU updates them
+	models := make([]mongo.WriteModel, len(batch))
+	for i, data := range batch {
+		doc, err := storedFields.document(data)
+		if err != nil {
+			return fmt.Errorf("error encoding TPS %d: %w", data.Id, err)
+		}
+		models[i] = mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"id": data.Id}).
+			SetReplacement(doc).
+			SetUpsert(true)
+	}
+
+	_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if isDuplicateKeyOnly(err) && errors.As(err, &bulkErr) {
+		fmt.Println("Skipped duplicate documents:", len(bulkErr.WriteErrors))
+		duplicatesSkipped.Add(float64(len(bulkErr.WriteErrors)))
+		tpsStored.Add(float64(len(batch) - len(bulkErr.WriteErrors)))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error inserting documents: %w", err)
+	}
+
+	tpsStored.Add(float64(len(batch)))
+	return nil
+}
+
+// True when every error of a BulkWrite is a duplicate key error, the races concurrent upserts run into
+func isDuplicateKeyOnly(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if !mongo.IsDuplicateKeyError(writeErr) {
+			return false
+		}
+	}
+	return true
+}
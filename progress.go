@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// TPS found while walking the hierarchy versus TPS already fetched
+var (
+	tpsDiscovered atomic.Int64
+	tpsProcessed  atomic.Int64
+)
+
+// Print progress every interval until ctx is done
+func reportProgress(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			printProgress()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// The total keeps growing until every village has been listed, so early percentages are only an estimate
+func printProgress() {
+	processed := tpsProcessed.Load()
+	discovered := tpsDiscovered.Load()
+	percent := 0.0
+	if discovered > 0 {
+		percent = float64(processed) / float64(discovered) * 100
+	}
+	fmt.Printf("%s / %s TPS processed (%.1f%%)\n", formatThousands(processed), formatThousands(discovered), percent)
+}
+
+// Format n with comma thousand separators, e.g. 823000 -> 823,000
+func formatThousands(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	if n < 0 {
+		return "-" + formatThousands(-n)
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Fields kept in the stored TPS documents, set from FIELDS. Nil keeps everything.
+var storedFields *fieldProjection
+
+// projection is a set of fields to keep, a nil sub projection keeps the whole field
+type projection map[string]projection
+
+// fieldProjection is the same projection by JSON and by BSON field name, they differ for fields without a bson tag
+type fieldProjection struct {
+	json projection
+	bson projection
+}
+
+// Parse FIELDS, a comma separated list of TPS fields by their JSON name, administrasi.<field> keeps a single
+// administrasi field. The id is always kept, it's what documents are upserted on.
+func parseFields(value string) (*fieldProjection, error) {
+	if value == "" {
+		return nil, nil
+	}
+	p := &fieldProjection{json: projection{"id": nil}, bson: projection{"id": nil}}
+	tps := reflect.TypeOf(TPSData{})
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		top, sub, nested := strings.Cut(name, ".")
+		field, ok := fieldByJSONName(tps, top)
+		if !ok {
+			return nil, fmt.Errorf("invalid FIELDS, unknown field %q", name)
+		}
+		jsonName, bsonName := jsonFieldName(field), bsonFieldName(field)
+		if !nested {
+			p.json[jsonName], p.bson[bsonName] = nil, nil
+			continue
+		}
+
+		subField, ok := fieldByJSONName(field.Type, sub)
+		if !ok {
+			return nil, fmt.Errorf("invalid FIELDS, unknown field %q", name)
+		}
+		// A field that's already kept whole stays whole
+		if keep, ok := p.json[jsonName]; ok && keep == nil {
+			continue
+		}
+		if p.json[jsonName] == nil {
+			p.json[jsonName], p.bson[bsonName] = projection{}, projection{}
+		}
+		p.json[jsonName][jsonFieldName(subField)] = nil
+		p.bson[bsonName][bsonFieldName(subField)] = nil
+	}
+	return p, nil
+}
+
+// Whether a top-level field, by JSON name, is stored
+func (p *fieldProjection) keeps(name string) bool {
+	if p == nil {
+		return true
+	}
+	_, ok := p.json[name]
+	return ok
+}
+
+func fieldByJSONName(t reflect.Type, name string) (reflect.StructField, bool) {
+	if t.Kind() != reflect.Struct {
+		return reflect.StructField{}, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.IsExported() && jsonFieldName(field) == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// The bson codec lowercases the Go name of fields without a bson tag
+func bsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("bson"), ",")
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+// Keep the fields of a JSON object in p
+func (p projection) filterJSON(b []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(b, &fields)
+	if err != nil {
+		return nil, err
+	}
+	kept := make(map[string]json.RawMessage, len(p))
+	for key, sub := range p {
+		value, ok := fields[key]
+		if !ok {
+			continue
+		}
+		if sub != nil {
+			value, err = sub.filterJSON(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		kept[key] = value
+	}
+	return json.Marshal(kept)
+}
+
+// Keep the fields of a BSON document in p, in their original order
+func (p projection) filterBSON(raw bson.Raw) (bson.D, error) {
+	elements, err := raw.Elements()
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	for _, element := range elements {
+		sub, ok := p[element.Key()]
+		if !ok {
+			continue
+		}
+		value := element.Value()
+		if sub != nil && value.Type == bsontype.EmbeddedDocument {
+			filtered, err := sub.filterBSON(value.Document())
+			if err != nil {
+				return nil, err
+			}
+			doc = append(doc, bson.E{Key: element.Key(), Value: filtered})
+			continue
+		}
+		doc = append(doc, bson.E{Key: element.Key(), Value: value})
+	}
+	return doc, nil
+}
+
+// The document a sink stores for a TPS, with only the fields in p
+func (p *fieldProjection) document(data TPSData) (interface{}, error) {
+	if p == nil {
+		return data, nil
+	}
+	raw, err := bson.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return p.bson.filterBSON(raw)
+}
+
+// The JSON object a sink writes for a TPS, with only the fields in p
+func (p *fieldProjection) object(data TPSData) (interface{}, error) {
+	if p == nil {
+		return data, nil
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	b, err = p.json.filterJSON(b)
+	return json.RawMessage(b), err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Set from SPLIT_BY_PROVINCE and MAX_OPEN_FILES, the file based sinks then write one file per province
+var (
+	splitByProvince bool
+	maxOpenFiles    = 64
+)
+
+// ProvinceSink routes every TPS to a sink of its own, one per province, each writing to path with the province Kode
+// before the extension, like data_tps.11.jsonl. With maxOpen set at most that many are open at once, the least
+// recently written is closed to make room and opened again for appending when its province comes up again.
+type ProvinceSink struct {
+	path    string
+	open    func(path string, appending bool) (Sink, error)
+	maxOpen int
+	order   *list.List
+	sinks   map[string]*list.Element
+	created map[string]bool
+}
+
+type provinceEntry struct {
+	province string
+	sink     Sink
+}
+
+// A maxOpen of 0 keeps every sink open, for sinks that don't hold a file open until Close like the CSV
+func NewProvinceSink(path string, maxOpen int, open func(path string, appending bool) (Sink, error)) *ProvinceSink {
+	return &ProvinceSink{
+		path:    path,
+		open:    open,
+		maxOpen: maxOpen,
+		order:   list.New(),
+		sinks:   map[string]*list.Element{},
+		created: map[string]bool{},
+	}
+}
+
+func (s *ProvinceSink) Store(ctx context.Context, data TPSData) error {
+	sink, err := s.sink(provinceOf(data))
+	if err != nil {
+		return err
+	}
+	return sink.Store(ctx, data)
+}
+
+// The open sink of a province, opening it and closing the least recently used one when needed
+func (s *ProvinceSink) sink(province string) (Sink, error) {
+	if element, ok := s.sinks[province]; ok {
+		s.order.MoveToFront(element)
+		return element.Value.(*provinceEntry).sink, nil
+	}
+
+	sink, err := s.open(provincePath(s.path, province), s.created[province])
+	if err != nil {
+		return nil, err
+	}
+	s.created[province] = true
+	s.sinks[province] = s.order.PushFront(&provinceEntry{province: province, sink: sink})
+	if s.maxOpen > 0 && s.order.Len() > s.maxOpen {
+		oldest := s.order.Remove(s.order.Back()).(*provinceEntry)
+		delete(s.sinks, oldest.province)
+		err = oldest.sink.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sink, nil
+}
+
+func (s *ProvinceSink) Flush(ctx context.Context) error {
+	var errs []error
+	for element := s.order.Front(); element != nil; element = element.Next() {
+		if flusher, ok := element.Value.(*provinceEntry).sink.(Flusher); ok {
+			errs = append(errs, flusher.Flush(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *ProvinceSink) Close() error {
+	var errs []error
+	for element := s.order.Front(); element != nil; element = element.Next() {
+		errs = append(errs, element.Value.(*provinceEntry).sink.Close())
+	}
+	s.order.Init()
+	s.sinks = map[string]*list.Element{}
+	return errors.Join(errs...)
+}
+
+// Kode of the province a TPS belongs to. TPS replayed from RAW_DIR have no path, their Kode starts with the province's.
+func provinceOf(data TPSData) string {
+	if len(data.Path) > 0 {
+		return data.Path[0].Kode
+	}
+	kode := strconv.FormatInt(data.Id, 10)
+	if len(kode) < 2 {
+		return "unknown"
+	}
+	return kode[:2]
+}
+
+func provincePath(path, province string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + province + ext
+}
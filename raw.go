@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Keep the exact bytes KPU returned for every stored TPS, gzip compressed. They go into the `raw` field
+// of the document, or into rawDir/<id>.json.gz when a directory is set.
+var (
+	storeRaw bool
+	rawDir   string
+)
+
+func gzipBytes(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(body)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(raw []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Write the compressed response of a TPS to rawDir, files are only replaced once the new one is complete
+func saveRaw(id int64, raw []byte) error {
+	err := os.MkdirAll(rawDir, 0755)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(rawDir, strconv.FormatInt(id, 10)+".json.gz")
+	tmp := dest + ".tmp"
+	err = os.WriteFile(tmp, raw, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Re-fetch every TPS stored with anomalies and update it in place, KPU often corrects them after the fact
+func recheckAnomalies(ctx context.Context, uri string) error {
+	client, err := connectMongo(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mongoDatabase)
+	collection := db.Collection(mongoCollection)
+	anomalies := db.Collection("anomalies")
+	// Stored separately the anomalies aren't on the TPS, every TPS with an event is re-checked
+	filter := bson.M{"anomalies.0": bson.M{"$exists": true}}
+	if anomalyStorage == anomaliesSeparate {
+		ids, err := anomalies.Distinct(ctx, "tps_id", bson.M{})
+		if err != nil {
+			return fmt.Errorf("error reading anomalies: %w", err)
+		}
+		filter = bson.M{"id": bson.M{"$in": ids}}
+	}
+	// Only the id is needed, every TPS is fetched again, and streamed since there can be many
+	cursor, err := collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"id": 1}))
+	if err != nil {
+		return fmt.Errorf("error reading anomalies: %w", err)
+	}
+	defer cursor.Close(context.Background())
+
+	var resolved, anomalous, failed atomic.Int64
+	checked := 0
+	wg := NewLimitedWaitGroup(concurrency)
+	for cursor.Next(ctx) {
+		var old TPSData
+		err := cursor.Decode(&old)
+		if err != nil {
+			wg.Wait()
+			return fmt.Errorf("error decoding TPS: %w", err)
+		}
+		checked++
+		wg.GoWhenFree(func() {
+			tpsURL, err := buildTPSURL(Location{Kode: strconv.FormatInt(old.Id, 10)})
+			if err != nil {
+				fmt.Println("Error re-fetching TPS:", old.Id, err)
+				failed.Add(1)
+				return
+			}
+			var data TPSData
+			_, err = withRetry(ctx, func() (err error) {
+				data, err = fetchDataTPS(ctx, tpsURL)
+				return err
+			})
+			if err != nil {
+				fmt.Println("Error re-fetching TPS:", old.Id, err)
+				failed.Add(1)
+				return
+			}
+
+			data.Id = old.Id
+			data = deriveTPS(data)
+			data.LastUpdated = time.Now()
+			if anomalyStorage != anomaliesEmbedded {
+				err = storeAnomalyEvents(ctx, anomalies, []TPSData{data})
+				if err != nil {
+					fmt.Println("Error updating TPS:", old.Id, err)
+					failed.Add(1)
+					return
+				}
+			}
+
+			// Only what was fetched again changes, everything else the crawl attached to the document is kept
+			update, err := recheckUpdate(data)
+			if err == nil {
+				_, err = collection.UpdateOne(ctx, bson.M{"id": data.Id}, update)
+			}
+			if err != nil {
+				fmt.Println("Error updating TPS:", old.Id, err)
+				failed.Add(1)
+				return
+			}
+			if len(data.Anomalies) == 0 {
+				resolved.Add(1)
+			} else {
+				anomalous.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	// When interrupted the counts so far are still reported
+	err = cursor.Err()
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("error reading anomalies: %w", err)
+	}
+
+	fmt.Println("Re-checked", checked, "TPS with anomalies")
+	fmt.Println("Resolved:", resolved.Load())
+	fmt.Println("Still anomalous:", anomalous.Load())
+	fmt.Println("Failed:", failed.Load())
+	return nil
+}
+
+// Fields of a TPS that recheck fetches or derives again
+var recheckedFields = func() *fieldProjection {
+	p, err := parseFields("mode,chart,votes,percentages,images,administrasi,psu,ts,timestamp,status_suara,status_adm,anomalies,turnout,last_updated,raw")
+	if err != nil {
+		panic(err)
+	}
+	return p
+}()
+
+// The $set of the re-checked fields, fields left out as empty are unset so nothing outdated stays behind.
+// The anomalies are left alone when they're stored separately.
+func recheckUpdate(data TPSData) (bson.M, error) {
+	doc, err := recheckedFields.document(data)
+	if err != nil {
+		return nil, err
+	}
+	set := bson.M{}
+	for _, element := range doc.(bson.D) {
+		set[element.Key] = element.Value
+	}
+	unset := bson.M{}
+	for field := range recheckedFields.bson {
+		if _, ok := set[field]; !ok {
+			unset[field] = ""
+		}
+	}
+	if anomalyStorage == anomaliesSeparate {
+		delete(set, "anomalies")
+		delete(unset, "anomalies")
+	}
+	// Without STORE_RAW the raw response of the crawl is kept
+	if !storeRaw {
+		delete(unset, "raw")
+	}
+
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update, nil
+}
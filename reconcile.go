@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// OfficialTotals are the numbers KPU published for a region, candidates are keyed like the chart
+type OfficialTotals struct {
+	SuaraSah      int64            `json:"suara_sah"`
+	SuaraTidakSah int64            `json:"suara_tidak_sah"`
+	SuaraTotal    int64            `json:"suara_total"`
+	Candidates    map[string]int64 `json:"candidates"`
+}
+
+// Read the official totals file, a JSON object of region Kode to its totals. Regions can be of any tingkat.
+func loadOfficialTotals(path string) (map[string]OfficialTotals, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading official totals: %w", err)
+	}
+	var official map[string]OfficialTotals
+	err = json.Unmarshal(body, &official)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing official totals: %w", err)
+	}
+	for kode := range official {
+		_, err := regionMatch(kode)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing official totals: %w", err)
+		}
+	}
+	return official, nil
+}
+
+// Sum the stored TPS of every region in the official totals file and print them next to the official numbers
+func reconcile(ctx context.Context, uri string, path string) error {
+	official, err := loadOfficialTotals(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Warning: official totals", path, "not found, nothing to reconcile against")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	client, err := connectMongo(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+	collection := client.Database(mongoDatabase).Collection(mongoCollection)
+
+	// One aggregation per tingkat present in the file, grouping on that many leading digits of the TPS id
+	lengths := map[int]bool{}
+	for kode := range official {
+		lengths[len(kode)] = true
+	}
+	scraped := map[string]Aggregate{}
+	for n := range lengths {
+		aggregates, err := aggregateRegions(ctx, collection, bson.M{}, regionPrefixExpr(n))
+		if err != nil {
+			return err
+		}
+		for _, agg := range aggregates {
+			scraped[agg.Region] = agg
+		}
+	}
+
+	kodes := make([]string, 0, len(official))
+	for kode := range official {
+		kodes = append(kodes, kode)
+	}
+	sort.Strings(kodes)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Region\tField\tScraped\tOfficial\tDelta\t")
+	discrepancies := 0
+	for _, kode := range kodes {
+		want := official[kode]
+		got := scraped[kode]
+		rows := []struct {
+			field             string
+			scraped, official int64
+		}{
+			{"suara_sah", got.SuaraSah, want.SuaraSah},
+			{"suara_tidak_sah", got.SuaraTidakSah, want.SuaraTidakSah},
+			{"suara_total", got.SuaraTotal, want.SuaraTotal},
+		}
+		candidates := make([]string, 0, len(want.Candidates))
+		for candidate := range want.Candidates {
+			candidates = append(candidates, candidate)
+		}
+		sort.Strings(candidates)
+		for _, candidate := range candidates {
+			rows = append(rows, struct {
+				field             string
+				scraped, official int64
+			}{candidateName(candidate), got.Candidates[candidate], want.Candidates[candidate]})
+		}
+
+		mismatch := false
+		for _, row := range rows {
+			delta := row.scraped - row.official
+			if delta != 0 {
+				mismatch = true
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%+d\t\n", kode, row.field, formatThousands(row.scraped), formatThousands(row.official), delta)
+		}
+		if mismatch {
+			discrepancies++
+		}
+	}
+	w.Flush()
+
+	fmt.Println(discrepancies, "of", len(kodes), "regions differ from the official totals")
+	return nil
+}
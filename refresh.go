@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// When set a crawl into mongo writes to refreshCollection, which only replaces the live collection once every
+// location was crawled without failures, so readers never see a half-written crawl
+var atomicRefresh bool
+
+// Collection a refresh is written to until it's swapped in
+func refreshCollection() string {
+	return mongoCollection + "_refresh"
+}
+
+// Rename the finished refresh over the live collection, the old one is dropped as part of the rename
+func swapRefresh(ctx context.Context, uri string) error {
+	client, err := connectMongo(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	err = client.Database("admin").RunCommand(ctx, bson.D{
+		{Key: "renameCollection", Value: mongoDatabase + "." + refreshCollection()},
+		{Key: "to", Value: mongoDatabase + "." + mongoCollection},
+		{Key: "dropTarget", Value: true},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("error renaming %s to %s: %w", refreshCollection(), mongoCollection, err)
+	}
+	return nil
+}
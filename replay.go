@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Parse the archived raw responses again without fetching anything, from RAW_DIR or otherwise from the raw field of
+// the stored TPS, and store them through STORAGE_BACKEND. Parsing and validation run exactly as during a crawl,
+// so a parsing fix or a new anomaly rule can be applied to historical data.
+func replay(ctx context.Context) error {
+	// There's no full crawl to swap in, the TPS are updated in place
+	atomicRefresh = false
+	sink, err := newSink(context.Background(), config.StorageBackend)
+	if err != nil {
+		return fmt.Errorf("error opening storage: %w", err)
+	}
+	dataChannel := make(chan TPSData, config.DataBufferSize)
+	writerPool := startWriters([]Sink{sink}, dataChannel)
+	// Stop reading once the writer stopped on a store error, nothing would drain the channel
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var replayed, failed int
+	store := func(id int64, raw []byte, old TPSData) {
+		data, err := replayTPS(id, raw, old)
+		if err != nil {
+			fmt.Println("Error replaying TPS:", id, err)
+			failed++
+			return
+		}
+		if !shouldStore(data) {
+			return
+		}
+		select {
+		case dataChannel <- data:
+			replayed++
+		case <-writerPool.stopped:
+			cancel()
+		case <-ctx.Done():
+		}
+	}
+	if rawDir != "" && (config.StorageBackend == "mongo" || config.StorageBackend == "aggregates") {
+		err = replayDirOverStored(ctx, config.MongoURL, rawDir, store)
+	} else if rawDir != "" {
+		err = replayDir(ctx, rawDir, noStoredTPS, store)
+	} else {
+		err = replayStored(ctx, config.MongoURL, store)
+	}
+
+	close(dataChannel)
+	err = errors.Join(err, writerPool.wait())
+	fmt.Println("Replayed", replayed, "TPS,", failed, "failed")
+	return err
+}
+
+// Parse one compressed raw response. Old is the TPS as it was stored, whatever can't be recomputed without
+// the network (path, scans) is kept from it.
+func replayTPS(id int64, raw []byte, old TPSData) (TPSData, error) {
+	body, err := gunzipBytes(raw)
+	if err != nil {
+		return TPSData{}, err
+	}
+	data, err := parseDataTPS("raw "+strconv.FormatInt(id, 10), body)
+	if err != nil {
+		return TPSData{}, err
+	}
+	data.Id = id
+	data.Path = old.Path
+	data.ImagePaths = old.ImagePaths
+	data.ImageKeys = old.ImageKeys
+	data.ImageHashes = old.ImageHashes
+	data.ImageMeta = old.ImageMeta
+	data.Raw = old.Raw
+	data = deriveTPS(data)
+	if unknown := unknownCandidates(data.Chart); rejectUnknownCandidates && len(unknown) > 0 {
+		return TPSData{}, &UnknownCandidateError{URL: "raw " + strconv.FormatInt(id, 10), Keys: unknown}
+	}
+	return data, nil
+}
+
+// Replay every <id>.json.gz in dir. Nothing but the response was archived, whatever else a TPS had comes from stored.
+func replayDir(ctx context.Context, dir string, stored func(int64) (TPSData, error), store func(int64, []byte, TPSData)) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		name, ok := strings.CutSuffix(entry.Name(), ".json.gz")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		id, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", entry.Name(), err)
+		}
+		old, err := stored(id)
+		if err != nil {
+			return fmt.Errorf("error reading TPS %d: %w", id, err)
+		}
+		store(id, raw, old)
+	}
+	return nil
+}
+
+// Replayed into a file there's nothing stored to keep, these TPS have no path or scans
+func noStoredTPS(id int64) (TPSData, error) {
+	return TPSData{}, nil
+}
+
+// Replay RAW_DIR into the collection the TPS are stored in. Each one is replaced, so it's looked up first
+// to keep its path and scans. A TPS that was never stored is added without.
+func replayDirOverStored(ctx context.Context, uri string, dir string, store func(int64, []byte, TPSData)) error {
+	client, err := connectMongo(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	collection := client.Database(mongoDatabase).Collection(mongoCollection)
+	return replayDir(ctx, dir, func(id int64) (TPSData, error) {
+		var old TPSData
+		err := collection.FindOne(ctx, bson.M{"id": id}).Decode(&old)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return TPSData{}, nil
+		}
+		return old, err
+	}, store)
+}
+
+// Replay every stored TPS that carries its raw response
+func replayStored(ctx context.Context, uri string, store func(int64, []byte, TPSData)) error {
+	client, err := connectMongo(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	// Stream the collection, it's far too big to hold in memory
+	collection := client.Database(mongoDatabase).Collection(mongoCollection)
+	cursor, err := collection.Find(ctx, bson.M{"raw": bson.M{"$exists": true}})
+	if err != nil {
+		return fmt.Errorf("error reading TPS: %w", err)
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(ctx) {
+		var old TPSData
+		err := cursor.Decode(&old)
+		if err != nil {
+			return fmt.Errorf("error decoding TPS: %w", err)
+		}
+		store(old.Id, old.Raw, old)
+	}
+	err = cursor.Err()
+	if err != nil {
+		return fmt.Errorf("error reading TPS: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Retries after a failed fetch and the delay before the first one, doubled on every further retry, configured in main
+var (
+	fetchRetries = 3
+	retryDelay   = time.Second
+)
+
+// RetryBudget caps the retries of the whole crawl, so a wide outage can't multiply every fetch into a retry storm.
+// *rate.Limiter is a token bucket budget, nil means unlimited.
+type RetryBudget interface {
+	Allow() bool
+}
+
+var retryBudget RetryBudget
+
+// Run fn until it succeeds, retrying with exponential backoff, and return how many attempts were made.
+// A missing resource or a malformed response won't change by asking again, so those are returned right away.
+func withRetry(ctx context.Context, fn func() error) (int, error) {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetryable(err) || attempt > fetchRetries || ctx.Err() != nil {
+			return attempt, err
+		}
+		// Out of budget, the failure is recorded like any other that ran out of retries
+		if retryBudget != nil && !retryBudget.Allow() {
+			retriesDenied.Add(1)
+			return attempt, err
+		}
+
+		// When KPU says how long to back off, that's exactly how long we wait
+		wait := delay
+		var tooManyErr *TooManyRequestsError
+		if errors.As(err, &tooManyErr) && tooManyErr.RetryAfter > 0 {
+			wait = tooManyErr.RetryAfter
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return attempt, err
+		}
+		delay *= 2
+	}
+}
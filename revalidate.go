@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Re-run the validation rules over the stored TPS without fetching anything from KPU, updating
+// anomalies and turnout where they changed and printing the anomalies found per province
+func validateStored(ctx context.Context, uri string) error {
+	client, err := connectMongo(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	// Stream the collection, it's far too big to hold in memory
+	db := client.Database(mongoDatabase)
+	collection := db.Collection(mongoCollection)
+	anomaliesCollection := db.Collection("anomalies")
+	if anomalyStorage != anomaliesEmbedded {
+		err = ensureAnomalyEventIndex(ctx, anomaliesCollection)
+		if err != nil {
+			return err
+		}
+	}
+	projection := bson.M{"id": 1, "mode": 1, "chart": 1, "administrasi": 1, "anomalies": 1, "turnout": 1, "image_meta": 1,
+		"timestamp": 1}
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetProjection(projection))
+	if err != nil {
+		return fmt.Errorf("error reading TPS: %w", err)
+	}
+	defer cursor.Close(context.Background())
+
+	report := map[string]map[AnomalyCode]int{}
+	var updates []mongo.WriteModel
+	// TPS with their recomputed anomalies, stored as events unless ANOMALIES_STORAGE is embedded
+	var events []TPSData
+	var checked, updated int
+	write := func() error {
+		err := storeAnomalyEvents(ctx, anomaliesCollection, events)
+		if err != nil {
+			return err
+		}
+		events = events[:0]
+		if len(updates) == 0 {
+			return nil
+		}
+		_, err = collection.BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return fmt.Errorf("error updating TPS: %w", err)
+		}
+		updated += len(updates)
+		updates = updates[:0]
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		var data TPSData
+		err := cursor.Decode(&data)
+		if err != nil {
+			return fmt.Errorf("error decoding TPS: %w", err)
+		}
+		checked++
+
+		anomalies := validateAdministrasi(data)
+		turnout := computeTurnout(data.Administrasi)
+		// Stored separately the anomalies aren't on the TPS, only the events are written
+		embedded := anomalyStorage != anomaliesSeparate
+		set := bson.M{}
+		if embedded && !sameAnomalies(anomalies, data.Anomalies) {
+			set["anomalies"] = anomalies
+		}
+		if turnout != data.Turnout {
+			set["turnout"] = turnout
+		}
+		if len(set) > 0 {
+			updates = append(updates, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"id": data.Id}).
+				SetUpdate(bson.M{"$set": set}))
+		}
+		if anomalyStorage != anomaliesEmbedded && len(anomalies) > 0 {
+			data.Anomalies = anomalies
+			events = append(events, data)
+		}
+		if len(updates) >= 500 || len(events) >= 500 {
+			err = write()
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(anomalies) == 0 {
+			continue
+		}
+		province := strconv.FormatInt(data.Id, 10)
+		if len(province) > 2 {
+			province = province[:2]
+		}
+		if report[province] == nil {
+			report[province] = map[AnomalyCode]int{}
+		}
+		for _, anomaly := range anomalies {
+			report[province][anomaly.Code]++
+		}
+	}
+	err = cursor.Err()
+	if err != nil {
+		return fmt.Errorf("error reading TPS: %w", err)
+	}
+	err = write()
+	if err != nil {
+		return err
+	}
+
+	printAnomalyReport(report)
+	fmt.Println("Validated", checked, "TPS,", updated, "updated")
+	return nil
+}
+
+// Anomalies are produced in a fixed order, so comparing them in order is enough
+func sameAnomalies(a, b []Anomaly) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func printAnomalyReport(report map[string]map[AnomalyCode]int) {
+	provinces := make([]string, 0, len(report))
+	for province := range report {
+		provinces = append(provinces, province)
+	}
+	sort.Strings(provinces)
+
+	for _, province := range provinces {
+		codes := make([]string, 0, len(report[province]))
+		for code := range report[province] {
+			codes = append(codes, string(code))
+		}
+		sort.Strings(codes)
+
+		fmt.Println("Province", province)
+		for _, code := range codes {
+			fmt.Printf("  %-24s %s\n", code, formatThousands(int64(report[province][AnomalyCode(code)])))
+		}
+	}
+}
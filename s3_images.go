@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// When IMAGE_S3_BUCKET is set, scans are uploaded to the bucket instead of saved under IMAGE_DIR, nil otherwise
+var imageStore *s3ImageStore
+
+// s3ImageStore uploads scans to an S3 compatible bucket, AWS itself or e.g. MinIO or R2 through endpoint.
+// Credentials come from the usual AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or any other source the AWS SDK reads.
+type s3ImageStore struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+	prefix   string
+}
+
+// MinIO and most self hosted endpoints need pathStyle, they don't serve buckets as subdomains
+func newS3ImageStore(ctx context.Context, bucket, prefix, endpoint, region string, pathStyle bool) (*s3ImageStore, error) {
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("error configuring S3: %w", err)
+	}
+	client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = pathStyle
+	})
+	return &s3ImageStore{
+		client: client,
+		// Scans above the part size, 5 MiB by default, are sent as a multipart upload
+		uploader: manager.NewUploader(client),
+		bucket:   bucket,
+		prefix:   prefix,
+	}, nil
+}
+
+// Object key of a scan, laid out like IMAGE_DIR: <prefix><tps id>/<file name>
+func (s *s3ImageStore) key(tpsId int64, imageURL string) (string, error) {
+	name, err := imagePath("", imageURL)
+	if err != nil {
+		return "", err
+	}
+	return s.prefix + path.Join(strconv.FormatInt(tpsId, 10), name), nil
+}
+
+// Fetch a scan and upload it under key, unless an earlier run already did
+func (s *s3ImageStore) upload(ctx context.Context, imageURL string, key string) error {
+	exists, err := s.exists(ctx, key)
+	if err != nil || exists {
+		return err
+	}
+
+	body, err := httpGet(ctx, imageURL)
+	if err != nil {
+		return err
+	}
+	return s.put(ctx, key, body)
+}
+
+func (s *s3ImageStore) put(ctx context.Context, key string, body []byte) error {
+	_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(http.DetectContentType(body)),
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *s3ImageStore) exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error looking up %s: %w", key, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Parse INTERVAL, either a Go duration like "15m" or a plain number of minutes
+func parseInterval(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if minutes, atoiErr := strconv.Atoi(value); atoiErr == nil {
+		interval, err = time.Duration(minutes)*time.Minute, nil
+	}
+	if err != nil || interval < 0 {
+		return 0, fmt.Errorf("invalid INTERVAL %q, expected minutes or a duration like 15m", value)
+	}
+	return interval, nil
+}
+
+// Crawl again every interval until ctx is done. Each run starts up to jitter later than scheduled so the
+// requests don't hit KPU on a fixed clock, and runs that would start while the previous one is still going are skipped.
+func crawlEvery(ctx context.Context, interval time.Duration, jitter time.Duration) {
+	for run := 1; ; run++ {
+		// Checkpoints and RESUME_FROM only resume the first run after a restart, later runs refresh everything
+		if run > 1 {
+			resumeFrom = ""
+			err := resetCheckpoints()
+			if err != nil {
+				fmt.Println("Error resetting checkpoints:", err)
+			}
+			resetSummary()
+		}
+
+		start := time.Now()
+		crawl(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		next := start.Add(interval)
+		for !next.After(time.Now()) {
+			fmt.Println("Info: crawl took longer than INTERVAL, skipping the run scheduled at", next.Format(time.RFC3339))
+			next = next.Add(interval)
+		}
+		if jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+		}
+		fmt.Println("Next crawl at", next.Format(time.RFC3339))
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
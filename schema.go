@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// When set every TPS response is checked against tps_schema.json before it's decoded. Go fills missing fields with
+// zeroes and a renamed field just disappears, the schema turns both into an error naming the field.
+var validateSchema bool
+
+// The JSON schema of a TPS response, only the keywords jsonSchema supports are used
+//
+//go:embed tps_schema.json
+var tpsSchemaJSON []byte
+
+var tpsSchema = mustParseSchema(tpsSchemaJSON)
+
+// jsonSchema is the subset of JSON schema needed to describe the KPU responses
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+}
+
+// "type" is either a single type or a list of them
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(b []byte) error {
+	var one string
+	if json.Unmarshal(b, &one) == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	err := json.Unmarshal(b, &many)
+	if err != nil {
+		return err
+	}
+	*t = many
+	return nil
+}
+
+func mustParseSchema(b []byte) *jsonSchema {
+	var schema jsonSchema
+	err := json.Unmarshal(b, &schema)
+	if err != nil {
+		panic(fmt.Sprintf("invalid embedded schema: %v", err))
+	}
+	return &schema
+}
+
+// Check a response against the schema, every violation is reported in a SchemaError
+func checkSchema(url string, schema *jsonSchema, body []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// Keep numbers as written so integers can be told apart from fractions
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return &ParseError{URL: url, Err: err}
+	}
+
+	var problems []string
+	schema.check(value, "", &problems)
+	if len(problems) > 0 {
+		return &SchemaError{URL: url, Problems: problems}
+	}
+	return nil
+}
+
+func (s *jsonSchema) check(value interface{}, path string, problems *[]string) {
+	if len(s.AnyOf) > 0 {
+		matched := false
+		for _, option := range s.AnyOf {
+			var optionProblems []string
+			option.check(value, path, &optionProblems)
+			if len(optionProblems) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			*problems = append(*problems, fmt.Sprintf("%s: unexpected %s", pathName(path), jsonType(value)))
+		}
+	}
+
+	if len(s.Type) > 0 && !s.allows(value) {
+		*problems = append(*problems, fmt.Sprintf("%s: expected %s, got %s", pathName(path), strings.Join(s.Type, " or "), jsonType(value)))
+		return
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := v[key]; !ok {
+				*problems = append(*problems, fmt.Sprintf("%s: missing %s", pathName(path), key))
+			}
+		}
+		// Sorted so the same response always reports the same problems in the same order
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			property, ok := s.Properties[key]
+			if !ok {
+				property = s.AdditionalProperties
+			}
+			if property != nil {
+				property.check(v[key], path+"."+key, problems)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.check(item, fmt.Sprintf("%s[%d]", path, i), problems)
+			}
+		}
+	}
+}
+
+func (s *jsonSchema) allows(value interface{}) bool {
+	actual := jsonType(value)
+	for _, t := range s.Type {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// JSON schema type of a value decoded with UseNumber
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func pathName(path string) string {
+	if path == "" {
+		return "response"
+	}
+	return strings.TrimPrefix(path, ".")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Serve the stored TPS data as a small JSON API until ctx is done
+func serve(ctx context.Context, uri string, addr string) error {
+	client, err := connectMongo(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mongoDatabase)
+	api := &api{collection: db.Collection(mongoCollection), locations: db.Collection("locations")}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tps/", api.handleTPS)
+	mux.HandleFunc("/region/", api.handleRegionSummary)
+	mux.HandleFunc("/search", api.handleSearch)
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	fmt.Println("Serving on", addr)
+	err = server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+type api struct {
+	collection *mongo.Collection
+	locations  *mongo.Collection
+}
+
+// GET /tps/{id}
+func (a *api) handleTPS(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/tps/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid TPS id")
+		return
+	}
+
+	var data TPSData
+	err = a.collection.FindOne(r.Context(), bson.M{"id": id}).Decode(&data)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeError(w, http.StatusNotFound, "TPS not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error reading TPS:", id, err)
+		writeError(w, http.StatusInternalServerError, "error reading TPS")
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// GET /region/{kode}/summary
+func (a *api) handleRegionSummary(w http.ResponseWriter, r *http.Request) {
+	kode, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/region/"), "/summary")
+	if !ok {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	match, err := regionMatch(kode)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	aggregates, err := aggregateRegions(r.Context(), a.collection, match, bson.M{"$literal": kode})
+	if err != nil {
+		fmt.Println("Error summarizing region:", kode, err)
+		writeError(w, http.StatusInternalServerError, "error summarizing region")
+		return
+	}
+	if len(aggregates) == 0 {
+		writeError(w, http.StatusNotFound, "no TPS stored for region")
+		return
+	}
+	writeJSON(w, http.StatusOK, aggregates[0])
+}
+
+// Most regions returned by a search, a short name like "kota" matches thousands
+const maxSearchResults = 100
+
+// GET /search?q={name}, the stored locations whose Nama contains q, ignoring case, shallowest first
+func (a *api) handleSearch(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		writeError(w, http.StatusBadRequest, "missing q")
+		return
+	}
+
+	filter := bson.M{"nama": primitive.Regex{Pattern: regexp.QuoteMeta(q), Options: "i"}}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "tingkat", Value: 1}, {Key: "kode", Value: 1}}).
+		SetLimit(maxSearchResults)
+	cursor, err := a.locations.Find(r.Context(), filter, opts)
+	if err != nil {
+		fmt.Println("Error searching locations:", q, err)
+		writeError(w, http.StatusInternalServerError, "error searching locations")
+		return
+	}
+	locations := []StoredLocation{}
+	err = cursor.All(r.Context(), &locations)
+	if err != nil {
+		fmt.Println("Error searching locations:", q, err)
+		writeError(w, http.StatusInternalServerError, "error searching locations")
+		return
+	}
+	writeJSON(w, http.StatusOK, locations)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Incremental mode, only TPS whose TS advanced past SINCE (or past their stored copy when SINCE=stored) are stored
+var (
+	sinceTime       time.Time
+	sinceStored     bool
+	timestampLookup TimestampLookup
+)
+
+// Configure the incremental mode from the SINCE value
+func parseSince(since string) error {
+	if since == "" {
+		return nil
+	}
+	if since == "stored" {
+		sinceStored = true
+		return nil
+	}
+	t, err := parseTS(since)
+	if err != nil {
+		return fmt.Errorf("invalid SINCE %q: %w", since, err)
+	}
+	sinceTime = t
+	return nil
+}
+
+// Stored timestamps of the TPS listed under a village, looked up in one query per village
+func storedTimestamps(ctx context.Context, tpsList []Location) map[int64]time.Time {
+	if !sinceStored {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(tpsList))
+	for _, tps := range tpsList {
+		id, err := strconv.ParseInt(tps.Kode, 10, 64)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	stored, err := timestampLookup.StoredTimestamps(ctx, ids)
+	if err != nil {
+		// Storing everything again is safe, upserts just refresh the same numbers
+		fmt.Println("Error looking up stored timestamps, storing every TPS:", err)
+		return nil
+	}
+	return stored
+}
+
+// Whether a fetched TPS changed since SINCE or since it was last stored. TPS without a
+// parseable TS are always stored since there's nothing to compare.
+func isUpdated(data TPSData, stored map[int64]time.Time) bool {
+	if data.Timestamp.IsZero() {
+		return true
+	}
+	if !sinceTime.IsZero() && !data.Timestamp.After(sinceTime) {
+		return false
+	}
+	if prev, ok := stored[data.Id]; ok && !data.Timestamp.After(prev) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Sink is a storage backend for crawled TPS data
+type Sink interface {
+	Store(ctx context.Context, data TPSData) error
+	Close() error
+}
+
+// Flusher is implemented by sinks that buffer data, Flush is called periodically by insertData
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// LocationStorer is implemented by sinks that can store the administrative hierarchy itself, every location
+// above the TPS with its path down from the province. Needed when MAX_TINGKAT stops the crawl above the TPS level.
+// Unlike Store it's called directly from the crawl goroutines.
+type LocationStorer interface {
+	StoreLocation(ctx context.Context, loc Location, path []PathEntry) error
+}
+
+// TimestampLookup is implemented by sinks that can tell when each TPS was last updated by KPU,
+// used with SINCE=stored to skip unchanged TPS
+type TimestampLookup interface {
+	StoredTimestamps(ctx context.Context, ids []int64) (map[int64]time.Time, error)
+}
+
+// MultiWriter is implemented by sinks that can be written by several insertData goroutines at once,
+// every goroutine gets its own Writer and the sink itself is closed once they're all done
+type MultiWriter interface {
+	Writer() Sink
+}
+
+// Open the sink selected by STORAGE_BACKEND
+func newSink(ctx context.Context, backend string) (Sink, error) {
+	switch backend {
+	case "", "mongo":
+		return NewMongoSink(ctx, config.MongoURL)
+	case "csv":
+		if splitByProvince {
+			// Rows are only written on Close, so no file is held open until then
+			return NewProvinceSink(outputPath("data_tps.csv"), 0, func(path string, _ bool) (Sink, error) {
+				return NewCSVSink(path), nil
+			}), nil
+		}
+		return NewCSVSink(outputPath("data_tps.csv")), nil
+	case "jsonl":
+		if splitByProvince {
+			return NewProvinceSink(outputPath("data_tps.jsonl"), maxOpenFiles, func(path string, appending bool) (Sink, error) {
+				return openJSONLSink(path, appending)
+			}), nil
+		}
+		return NewJSONLSink(outputPath("data_tps.jsonl"))
+	case "sqlite":
+		return NewSQLiteSink(ctx, outputPath("data_tps.db"))
+	case "aggregates":
+		return NewAggregateSink(ctx, config.MongoURL)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// Output file for the file based sinks, from OUTPUT_PATH or the given default
+func outputPath(def string) string {
+	if config.OutputPath == "" {
+		return def
+	}
+	return config.OutputPath
+}
+
+// Function to receive data from channel and hand it to the sink. A flush can also be requested on
+// flushRequests, everything already sent on dataChannel is stored before flushing and the result is
+// sent back on the request.
+func insertData(ctx context.Context, sink Sink, dataChannel <-chan TPSData, flushRequests <-chan chan error) error {
+	ticker := time.NewTicker(config.FlushInterval)
+	defer ticker.Stop()
+
+	store := func(data TPSData) error {
+		kode := strconv.FormatInt(data.Id, 10)
+		storeCtx, span := startSpan(trace.ContextWithSpanContext(ctx, data.spanContext), "store", kode)
+		defer span.End()
+		data.LastUpdated = time.Now()
+		err := sink.Store(storeCtx, data)
+		if err != nil {
+			return spanError(span, &StoreError{Kode: kode, Err: err})
+		}
+		recordsStored.Add(1)
+		return nil
+	}
+	flush := func() error {
+		flusher, ok := sink.(Flusher)
+		if !ok {
+			return nil
+		}
+		flushCtx, span := tracer.Start(ctx, "flush")
+		defer span.End()
+		err := flusher.Flush(flushCtx)
+		if err != nil {
+			return spanError(span, &StoreError{Err: err})
+		}
+		return nil
+	}
+
+	for {
+		var err error
+		select {
+		case data, ok := <-dataChannel:
+			if !ok {
+				err := sink.Close()
+				fmt.Printf("Ended")
+				if err != nil {
+					return &StoreError{Err: err}
+				}
+				return nil
+			}
+			err = store(data)
+		case <-ticker.C:
+			err = flush()
+		case reply := <-flushRequests:
+			err = drain(dataChannel, store)
+			if err == nil {
+				err = flush()
+			}
+			reply <- err
+		}
+		if err != nil {
+			sink.Close()
+			return err
+		}
+	}
+}
+
+// Store whatever is buffered in dataChannel right now, without waiting for more
+func drain(dataChannel <-chan TPSData, store func(TPSData) error) error {
+	for {
+		select {
+		case data, ok := <-dataChannel:
+			if !ok {
+				return nil
+			}
+			err := store(data)
+			if err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// writerPool runs an insertData goroutine per sink, all draining the same channel
+type writerPool struct {
+	flushRequests []chan chan error
+	exited        []chan struct{}
+	errs          []error
+	// Closed as soon as any writer exits, after a store error that's long before the channel is closed
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// Closed once a writer of the running pool stopped, sendData doesn't wait on a channel nobody may drain anymore
+var writersStopped <-chan struct{}
+
+// The writers keep their own context so buffered records are still flushed after a cancellation,
+// senders watch stopped instead
+func startWriters(sinks []Sink, dataChannel <-chan TPSData) *writerPool {
+	pool := &writerPool{
+		flushRequests: make([]chan chan error, len(sinks)),
+		exited:        make([]chan struct{}, len(sinks)),
+		errs:          make([]error, len(sinks)),
+		stopped:       make(chan struct{}),
+	}
+	writersStopped = pool.stopped
+	for i, sink := range sinks {
+		pool.flushRequests[i] = make(chan chan error)
+		pool.exited[i] = make(chan struct{})
+		go func(i int, sink Sink) {
+			defer pool.stopOnce.Do(func() { close(pool.stopped) })
+			defer close(pool.exited[i])
+			pool.errs[i] = insertData(context.Background(), sink, dataChannel, pool.flushRequests[i])
+		}(i, sink)
+	}
+	return pool
+}
+
+// Ask every writer to store and flush everything sent so far
+func (p *writerPool) flush() error {
+	var errs []error
+	for i := range p.flushRequests {
+		err := requestFlush(p.flushRequests[i], p.exited[i])
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Wait for every writer to exit after the channel was closed
+func (p *writerPool) wait() error {
+	for _, exited := range p.exited {
+		<-exited
+	}
+	return errors.Join(p.errs...)
+}
+
+// Ask the writer to store and flush everything sent so far, writerExited unblocks the request if the writer is gone
+func requestFlush(flushRequests chan<- chan error, writerExited <-chan struct{}) error {
+	reply := make(chan error, 1)
+	select {
+	case flushRequests <- reply:
+	case <-writerExited:
+		return errors.New("writer stopped")
+	}
+	return <-reply
+}
+
+// DryRunSink only counts the records it receives, used with DRY_RUN to crawl without touching any storage
+type DryRunSink struct {
+	count atomic.Int64
+}
+
+func (s *DryRunSink) Store(ctx context.Context, data TPSData) error {
+	s.count.Add(1)
+	return nil
+}
+
+func (s *DryRunSink) StoreLocation(ctx context.Context, loc Location, path []PathEntry) error {
+	return nil
+}
+
+// Failures are only logged in a dry run
+func (s *DryRunSink) StoreFailure(ctx context.Context, failure FailedFetch) error {
+	return nil
+}
+
+// Counting is safe from any number of writers
+func (s *DryRunSink) Writer() Sink {
+	return s
+}
+
+func (s *DryRunSink) Close() error {
+	return nil
+}
+
+func (s *DryRunSink) Count() int64 {
+	return s.count.Load()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// CountedLookup is implemented by sinks that can tell which TPS are already stored with their votes counted,
+// used with SKIP_EXISTING to fill in only what a previous run didn't get
+type CountedLookup interface {
+	CountedTPS(ctx context.Context, ids []int64) (map[int64]bool, error)
+}
+
+// Skip fetching TPS already stored with status_suara true, nil when disabled
+var countedLookup CountedLookup
+
+// TPS under a village that are already stored and counted, looked up in one query per village
+func existingTPS(ctx context.Context, tpsList []Location) map[int64]bool {
+	if countedLookup == nil {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(tpsList))
+	for _, tps := range tpsList {
+		id, err := strconv.ParseInt(tps.Kode, 10, 64)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	existing, err := countedLookup.CountedTPS(ctx, ids)
+	if err != nil {
+		// Fetching everything is safe, upserts just refresh the same numbers
+		fmt.Println("Error looking up existing TPS, fetching every TPS:", err)
+		return nil
+	}
+	return existing
+}
+
+// Whether a TPS listed under a village can be skipped
+func isExisting(tps Location, existing map[int64]bool) bool {
+	if len(existing) == 0 {
+		return false
+	}
+	id, err := strconv.ParseInt(tps.Kode, 10, 64)
+	return err == nil && existing[id]
+}
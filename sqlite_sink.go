@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteSink stores TPS data in a single SQLite file, handy for sharing a dataset without MongoDB.
+// Nested fields (chart, votes, administrasi, ...) are stored as JSON in text columns.
+type SQLiteSink struct {
+	db *sql.DB
+	tx *sql.Tx
+}
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS data_tps (
+	id INTEGER PRIMARY KEY,
+	mode TEXT,
+	ts TEXT,
+	timestamp TEXT,
+	status_suara INTEGER,
+	status_adm INTEGER,
+	suara_sah INTEGER,
+	suara_tidak_sah INTEGER,
+	suara_total INTEGER,
+	turnout REAL,
+	chart TEXT,
+	votes TEXT,
+	images TEXT,
+	administrasi TEXT,
+	psu TEXT,
+	anomalies TEXT,
+	image_paths TEXT,
+	image_hashes TEXT,
+	path TEXT,
+	last_updated TEXT
+)`
+
+// Columns added after the table was first released, always added with ALTER TABLE so files written by earlier
+// versions get them too
+var sqliteAddedColumns = []struct{ name, kind string }{
+	{"stale", "INTEGER"},
+	{"percentages", "TEXT"},
+	{"image_keys", "TEXT"},
+	{"image_meta", "TEXT"},
+	{"raw", "BLOB"},
+}
+
+const sqliteUpsert = `INSERT INTO data_tps (
+	id, mode, ts, timestamp, status_suara, status_adm, suara_sah, suara_tidak_sah, suara_total, turnout, stale,
+	chart, votes, percentages, images, administrasi, psu, anomalies, image_paths, image_keys, image_hashes, image_meta, path,
+	raw, last_updated
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(id) DO UPDATE SET
+	mode = excluded.mode,
+	ts = excluded.ts,
+	timestamp = excluded.timestamp,
+	status_suara = excluded.status_suara,
+	status_adm = excluded.status_adm,
+	suara_sah = excluded.suara_sah,
+	suara_tidak_sah = excluded.suara_tidak_sah,
+	suara_total = excluded.suara_total,
+	turnout = excluded.turnout,
+	stale = excluded.stale,
+	chart = excluded.chart,
+	votes = excluded.votes,
+	percentages = excluded.percentages,
+	images = excluded.images,
+	administrasi = excluded.administrasi,
+	psu = excluded.psu,
+	anomalies = excluded.anomalies,
+	image_paths = excluded.image_paths,
+	image_keys = excluded.image_keys,
+	image_hashes = excluded.image_hashes,
+	image_meta = excluded.image_meta,
+	path = excluded.path,
+	raw = excluded.raw,
+	last_updated = excluded.last_updated`
+
+func NewSQLiteSink(ctx context.Context, path string) (*SQLiteSink, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// Only insertData writes, a single connection avoids SQLITE_BUSY between pooled connections
+	db.SetMaxOpenConns(1)
+
+	_, err = db.ExecContext(ctx, sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating data_tps table: %w", err)
+	}
+	err = addSQLiteColumns(ctx, db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error updating data_tps table: %w", err)
+	}
+	return &SQLiteSink{db: db}, nil
+}
+
+// Add the columns an existing data_tps table doesn't have yet
+func addSQLiteColumns(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM pragma_table_info('data_tps')")
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range sqliteAddedColumns {
+		if existing[column.name] {
+			continue
+		}
+		_, err = db.ExecContext(ctx, "ALTER TABLE data_tps ADD COLUMN "+column.name+" "+column.kind)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rows are written inside a transaction that is committed on every flush, one commit per row is very slow
+func (s *SQLiteSink) Store(ctx context.Context, data TPSData) error {
+	if s.tx == nil {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		s.tx = tx
+	}
+
+	var columns []interface{}
+	for _, v := range []interface{}{data.Chart, data.Votes, data.Percentages, data.Images, data.Administrasi, data.PSU, data.Anomalies,
+		data.ImagePaths, data.ImageKeys, data.ImageHashes, data.ImageMeta, data.Path} {
+		column, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("error encoding TPS %d: %w", data.Id, err)
+		}
+		columns = append(columns, string(column))
+	}
+
+	adm := data.Administrasi
+	args := []interface{}{
+		data.Id, data.Mode, data.TS, formatTime(data.Timestamp), data.StatusSuara, data.StatusAdm,
+		adm.SuaraSah, adm.SuaraTidakSah, adm.SuaraTotal, data.Turnout, data.Stale,
+	}
+	args = append(args, columns...)
+	args = append(args, data.Raw, formatTime(data.LastUpdated))
+	_, err := s.tx.ExecContext(ctx, sqliteUpsert, args...)
+	if err != nil {
+		return fmt.Errorf("error storing TPS %d: %w", data.Id, err)
+	}
+	return nil
+}
+
+func (s *SQLiteSink) Flush(ctx context.Context) error {
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Commit()
+	s.tx = nil
+	return err
+}
+
+func (s *SQLiteSink) Close() error {
+	err := s.Flush(context.Background())
+	closeErr := s.db.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Times are stored as RFC3339 text, SQLite has no time type, and empty when unknown
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A TPS still being counted is stale once its KPU timestamp hasn't moved for STALE_CYCLES scheduled crawls while
+// another TPS of the same village did move, 0 turns the check off. Only a crawl with INTERVAL runs enough cycles.
+var staleCycles = 3
+
+// staleTracker remembers the timestamp of every TPS between scheduled crawls
+type staleTracker struct {
+	mu    sync.Mutex
+	cycle int
+	tps   map[int64]tpsSeen
+	// Last cycle in which any TPS of the village advanced, keyed by the village Kode
+	regions map[string]int
+}
+
+type tpsSeen struct {
+	timestamp time.Time
+	changed   int
+}
+
+// Kept for the whole process, unlike the per run counters it's never reset
+var staleTPS = newStaleTracker()
+
+func newStaleTracker() *staleTracker {
+	return &staleTracker{tps: map[int64]tpsSeen{}, regions: map[string]int{}}
+}
+
+// Start the next crawl cycle
+func (t *staleTracker) nextCycle() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cycle++
+}
+
+// Record the timestamp of a TPS in its village and report whether it's stale
+func (t *staleTracker) observe(data TPSData, region string) bool {
+	if staleCycles == 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seen, ok := t.tps[data.Id]
+	if !ok || !data.Timestamp.Equal(seen.timestamp) {
+		// Seeing a TPS for the first time isn't progress, the village only moves when a known TPS does
+		if ok {
+			t.regions[region] = t.cycle
+		}
+		t.tps[data.Id] = tpsSeen{timestamp: data.Timestamp, changed: t.cycle}
+		return false
+	}
+	return !data.StatusSuara && t.cycle-seen.changed >= staleCycles && t.regions[region] > seen.changed
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Counters for the end of run summary, tpsDiscovered and tpsProcessed in progress.go complete the picture
+var (
+	locationsVisited atomic.Int64
+	emptyLocations   atomic.Int64
+	tpsSkipped       atomic.Int64
+	duplicateTPS     atomic.Int64
+	suaraCounted     atomic.Int64
+	suaraNotCounted  atomic.Int64
+	recordsStored    atomic.Int64
+	fetchFailures    atomic.Int64
+	retriesDenied    atomic.Int64
+	anomaliesFound   atomic.Int64
+	staleFound       atomic.Int64
+	failedBatches    atomic.Int64
+)
+
+// Print what the run actually did, so a clean exit can be told apart from a run that stored nothing
+func printSummary() {
+	fmt.Println("Summary:")
+	fmt.Printf("  %-20s %s\n", "Locations visited", formatThousands(locationsVisited.Load()))
+	fmt.Printf("  %-20s %s\n", "Empty locations", formatThousands(emptyLocations.Load()))
+	fmt.Printf("  %-20s %s\n", "TPS found", formatThousands(tpsDiscovered.Load()))
+	fmt.Printf("  %-20s %s\n", "TPS already stored", formatThousands(tpsSkipped.Load()))
+	fmt.Printf("  %-20s %s\n", "Duplicate TPS", formatThousands(duplicateTPS.Load()))
+	fmt.Printf("  %-20s %s\n", "TPS counted", formatThousands(suaraCounted.Load()))
+	fmt.Printf("  %-20s %s\n", "TPS not counted", formatThousands(suaraNotCounted.Load()))
+	fmt.Printf("  %-20s %s\n", "Records stored", formatThousands(recordsStored.Load()))
+	fmt.Printf("  %-20s %s\n", "Fetch failures", formatThousands(fetchFailures.Load()))
+	fmt.Printf("  %-20s %s\n", "Retries over budget", formatThousands(retriesDenied.Load()))
+	fmt.Printf("  %-20s %s\n", "Anomalies detected", formatThousands(anomaliesFound.Load()))
+	fmt.Printf("  %-20s %s\n", "Stale TPS", formatThousands(staleFound.Load()))
+	fmt.Printf("  %-20s %s\n", "Failed batches", formatThousands(failedBatches.Load()))
+	printBytesSaved()
+	printLocationCacheHits()
+	printSlowestRegions()
+}
+
+// Start the counters over for the next scheduled crawl
+func resetSummary() {
+	for _, counter := range []*atomic.Int64{
+		&locationsVisited, &emptyLocations, &tpsSkipped, &duplicateTPS, &suaraCounted, &suaraNotCounted, &recordsStored, &fetchFailures, &retriesDenied, &anomaliesFound, &staleFound, &failedBatches,
+		&tpsDiscovered, &tpsProcessed, &tpsEnqueued, &bytesReceived, &bytesDecoded, &locationCacheHits, &locationCacheMisses,
+	} {
+		counter.Store(0)
+	}
+	resetTimings()
+}
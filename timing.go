@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Regions printed at the end of the crawl, slowest first
+const slowestRegions = 5
+
+// Latency of the requests towards one province, to spot slow regional endpoints
+type regionTiming struct {
+	requests int64
+	total    time.Duration
+	max      time.Duration
+}
+
+var (
+	timingsMu sync.Mutex
+	timings   = map[string]*regionTiming{}
+)
+
+// Record how long a request took against the province it belongs to
+func recordTiming(url string, d time.Duration) {
+	region := regionOf(url)
+	timingsMu.Lock()
+	defer timingsMu.Unlock()
+	t, ok := timings[region]
+	if !ok {
+		t = &regionTiming{}
+		timings[region] = t
+	}
+	t.requests++
+	t.total += d
+	t.max = max(t.max, d)
+}
+
+// Province Kode of a KPU url, the first path element after the base url. The list of provinces
+// itself (0.json) is counted as "-" and anything outside the base urls, like C1 scans, as "other".
+func regionOf(url string) string {
+	rest, ok := strings.CutPrefix(url, tpsBaseURL)
+	if !ok {
+		rest, ok = strings.CutPrefix(url, baseURL)
+	}
+	if !ok {
+		return "other"
+	}
+	rest = strings.TrimSuffix(rest, ".json")
+	region, _, _ := strings.Cut(rest, "/")
+	if region == "" || region == "0" {
+		return "-"
+	}
+	return region
+}
+
+// Print the provinces with the highest average latency
+func printSlowestRegions() {
+	timingsMu.Lock()
+	defer timingsMu.Unlock()
+	if len(timings) == 0 {
+		return
+	}
+
+	regions := make([]string, 0, len(timings))
+	for region := range timings {
+		regions = append(regions, region)
+	}
+	average := func(region string) time.Duration {
+		t := timings[region]
+		return t.total / time.Duration(t.requests)
+	}
+	sort.Slice(regions, func(i, j int) bool { return average(regions[i]) > average(regions[j]) })
+
+	fmt.Println("Slowest regions:")
+	for _, region := range regions[:min(len(regions), slowestRegions)] {
+		t := timings[region]
+		fmt.Printf("  %-20s avg %v, max %v over %s requests\n", region, average(region).Round(time.Millisecond),
+			t.max.Round(time.Millisecond), formatThousands(t.requests))
+	}
+}
+
+func resetTimings() {
+	timingsMu.Lock()
+	defer timingsMu.Unlock()
+	timings = map[string]*regionTiming{}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans go nowhere until startTracing installs a provider, the tracer picks it up then
+var tracer = otel.Tracer("github.com/hendri-marcolia/go-sipantau")
+
+// Export spans to the OTLP/HTTP collector at endpoint, the returned function flushes what's left and stops.
+// Sampling follows the standard OTEL_TRACES_SAMPLER variables, every TPS is traced by default.
+func startTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(strings.TrimSuffix(endpoint, "/")+"/v1/traces"))
+	if err != nil {
+		return nil, fmt.Errorf("error creating OTLP exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "go-sipantau"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start a span about the location or TPS kode
+func startSpan(ctx context.Context, name string, kode string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attribute.String("kode", kode)))
+}
+
+// Mark the span as failed, err is returned for the caller to pass on
+func spanError(span trace.Span, err error) error {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return err
+}
+
+// Kode of the location or TPS a KPU url is about, its file name without .json
+func kodeOf(url string) string {
+	return strings.TrimSuffix(url[strings.LastIndex(url, "/")+1:], ".json")
+}
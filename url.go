@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Root of the KPU region hierarchy (wilayah) and of the per TPS vote data (hhcw), configured in main
+// and variables so tests can point the crawl at a local server
+var (
+	baseURL    = "https://sirekap-obj-data.kpu.go.id/wilayah/pemilu/ppwp/"
+	tpsBaseURL = "https://sirekap-obj-data.kpu.go.id/pemilu/hhcw/ppwp/"
+)
+
+// Vote data of each race, selected with ELECTION_TYPE. Every race shares the same region tree.
+const electionTPSBaseURL = "https://sirekap-obj-data.kpu.go.id/pemilu/hhcw/%s/"
+
+var electionTypes = map[string]string{
+	"ppwp":   "presidential",
+	"pdpr":   "DPR RI",
+	"pdpd":   "DPD",
+	"pdprdp": "DPRD provinsi",
+	"pdprdk": "DPRD kabupaten/kota",
+}
+
+// TPS base URL of a race, e.g. pdpr -> https://sirekap-obj-data.kpu.go.id/pemilu/hhcw/pdpr/
+func tpsBaseURLFor(electionType string) (string, error) {
+	if _, ok := electionTypes[electionType]; !ok {
+		return "", fmt.Errorf("unknown ELECTION_TYPE %q, expected ppwp, pdpr, pdpd, pdprdp or pdprdk", electionType)
+	}
+	return fmt.Sprintf(electionTPSBaseURL, electionType), nil
+}
+
+// Length of a Kode at each tingkat, every Kode starts with the Kode of its parent
+var kodeLengths = []int{2, 4, 6, 10, 13}
+
+// Path of a location below a base URL, the Kode of every ancestor followed by its own,
+// e.g. 1101012001001 -> 11/1101/110101/1101012001/1101012001001
+func kodePath(kode string) (string, error) {
+	var parts []string
+	for _, n := range kodeLengths {
+		if n > len(kode) {
+			break
+		}
+		parts = append(parts, kode[:n])
+	}
+	if len(parts) == 0 || len(parts[len(parts)-1]) != len(kode) {
+		return "", fmt.Errorf("unexpected kode %q", kode)
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// Vote data endpoint of a TPS
+func buildTPSURL(loc Location) (string, error) {
+	path, err := kodePath(loc.Kode)
+	if err != nil {
+		return "", err
+	}
+	return tpsBaseURL + path + ".json", nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestKodePath(t *testing.T) {
+	tests := []struct {
+		kode string
+		want string
+	}{
+		{"11", "11"},
+		{"1101", "11/1101"},
+		{"110101", "11/1101/110101"},
+		{"1101012001", "11/1101/110101/1101012001"},
+		{"1101012001001", "11/1101/110101/1101012001/1101012001001"},
+	}
+	for _, tt := range tests {
+		got, err := kodePath(tt.kode)
+		if err != nil {
+			t.Errorf("kodePath(%q): unexpected error %v", tt.kode, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("kodePath(%q) = %q, want %q", tt.kode, got, tt.want)
+		}
+	}
+}
+
+func TestKodePathRejectsUnexpectedKode(t *testing.T) {
+	for _, kode := range []string{"", "1", "110", "11010120010011"} {
+		_, err := kodePath(kode)
+		if err == nil {
+			t.Errorf("kodePath(%q): expected an error", kode)
+		}
+	}
+}
+
+func TestBuildTPSURL(t *testing.T) {
+	old := tpsBaseURL
+	t.Cleanup(func() { tpsBaseURL = old })
+	tpsBaseURL = "https://example.com/pemilu/hhcw/ppwp/"
+
+	got, err := buildTPSURL(Location{Kode: "1101012001001", Tingkat: 5})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "https://example.com/pemilu/hhcw/ppwp/11/1101/110101/1101012001/1101012001001.json"
+	if got != want {
+		t.Errorf("buildTPSURL = %q, want %q", got, want)
+	}
+}
+
+func TestTPSBaseURLFor(t *testing.T) {
+	got, err := tpsBaseURLFor("pdpr")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "https://sirekap-obj-data.kpu.go.id/pemilu/hhcw/pdpr/"
+	if got != want {
+		t.Errorf("tpsBaseURLFor(pdpr) = %q, want %q", got, want)
+	}
+
+	_, err = tpsBaseURLFor("pilkada")
+	if err == nil {
+		t.Error("tpsBaseURLFor(pilkada): expected an error")
+	}
+}
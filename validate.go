@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AnomalyCode identifies a class of inconsistency in the numbers of a TPS
+type AnomalyCode string
+
+const (
+	// suara_sah + suara_tidak_sah != suara_total
+	AnomalyTotalMismatch AnomalyCode = "TOTAL_MISMATCH"
+	// The chart adds up to less than suara_sah
+	AnomalyChartMismatch AnomalyCode = "CHART_MISMATCH"
+	// The chart adds up to more than suara_sah
+	AnomalyChartExceedsValid AnomalyCode = "CHART_EXCEEDS_VALID"
+	// A single candidate has more votes than suara_sah
+	AnomalyCandidateExceedsValid AnomalyCode = "CANDIDATE_EXCEEDS_VALID"
+	// More voters showed up than were eligible to vote
+	AnomalyTurnoutExceeds100 AnomalyCode = "TURNOUT_EXCEEDS_100"
+	// The numbers were entered in a mode listed in UNVERIFIED_MODES, e.g. unconfirmed OCR
+	AnomalyModeUnverified AnomalyCode = "MODE_UNVERIFIED"
+	// The chart has a key that isn't in the candidate mapping, e.g. another election fetched by mistake
+	AnomalyUnknownCandidate AnomalyCode = "UNKNOWN_CANDIDATE"
+	// A C1 scan is below IMAGE_MIN_BYTES or IMAGE_MIN_WIDTH, likely blank or a placeholder
+	AnomalySmallImage AnomalyCode = "SMALL_IMAGE"
+)
+
+// KPU doesn't document the values of mode, so which ones count as unverified is configured
+var unverifiedModes = map[string]bool{}
+
+// Modes are compared and stored trimmed and in lower case
+func normalizeMode(mode string) string {
+	return strings.ToLower(strings.TrimSpace(mode))
+}
+
+// Parse UNVERIFIED_MODES, a comma separated list of mode values
+func parseUnverifiedModes(value string) map[string]bool {
+	modes := map[string]bool{}
+	for _, mode := range strings.Split(value, ",") {
+		mode = normalizeMode(mode)
+		if mode != "" {
+			modes[mode] = true
+		}
+	}
+	return modes
+}
+
+// Anomaly is a detected inconsistency, Detail carries the offending values for humans
+type Anomaly struct {
+	Code   AnomalyCode `json:"code" bson:"code"`
+	Detail string      `json:"detail" bson:"detail"`
+}
+
+// Check that the vote numbers of a TPS add up, returning every inconsistency found
+func validateAdministrasi(data TPSData) []Anomaly {
+	// Never nil, so clean records are stored as an empty array rather than null
+	anomalies := []Anomaly{}
+	adm := data.Administrasi
+
+	if adm.SuaraSah+adm.SuaraTidakSah != adm.SuaraTotal {
+		anomalies = append(anomalies, Anomaly{
+			Code:   AnomalyTotalMismatch,
+			Detail: fmt.Sprintf("suara_sah (%d) + suara_tidak_sah (%d) != suara_total (%d)", adm.SuaraSah, adm.SuaraTidakSah, adm.SuaraTotal),
+		})
+	}
+
+	if len(data.Chart) > 0 {
+		candidates := make([]string, 0, len(data.Chart))
+		for candidate := range data.Chart {
+			candidates = append(candidates, candidate)
+		}
+		sort.Strings(candidates)
+
+		chartTotal := 0
+		for _, candidate := range candidates {
+			votes := data.Chart[candidate]
+			chartTotal += votes
+			if !knownCandidate(candidate) {
+				anomalies = append(anomalies, Anomaly{
+					Code:   AnomalyUnknownCandidate,
+					Detail: fmt.Sprintf("candidate %s is not in the candidate mapping", candidate),
+				})
+			}
+			if votes > adm.SuaraSah {
+				anomalies = append(anomalies, Anomaly{
+					Code:   AnomalyCandidateExceedsValid,
+					Detail: fmt.Sprintf("candidate %s (%d) > suara_sah (%d)", candidate, votes, adm.SuaraSah),
+				})
+			}
+		}
+
+		if chartTotal > adm.SuaraSah {
+			anomalies = append(anomalies, Anomaly{
+				Code:   AnomalyChartExceedsValid,
+				Detail: fmt.Sprintf("chart total (%d) > suara_sah (%d)", chartTotal, adm.SuaraSah),
+			})
+		} else if chartTotal < adm.SuaraSah {
+			anomalies = append(anomalies, Anomaly{
+				Code:   AnomalyChartMismatch,
+				Detail: fmt.Sprintf("chart total (%d) < suara_sah (%d)", chartTotal, adm.SuaraSah),
+			})
+		}
+	}
+
+	if unverifiedModes[data.Mode] {
+		anomalies = append(anomalies, Anomaly{
+			Code:   AnomalyModeUnverified,
+			Detail: fmt.Sprintf("mode %q is unverified", data.Mode),
+		})
+	}
+
+	if turnout := computeTurnout(adm); turnout > 1 {
+		anomalies = append(anomalies, Anomaly{
+			Code:   AnomalyTurnoutExceeds100,
+			Detail: fmt.Sprintf("turnout %.1f%% > 100%%", turnout*100),
+		})
+	}
+
+	for i, meta := range data.ImageMeta {
+		if smallImage(meta) {
+			// Stored before the url was recorded every scan had an entry, in the order of images
+			name := strconv.Itoa(i)
+			if meta.URL != "" {
+				name = path.Base(meta.URL)
+			}
+			anomalies = append(anomalies, Anomaly{
+				Code:   AnomalySmallImage,
+				Detail: fmt.Sprintf("image %s is %d bytes, %dx%d", name, meta.Bytes, meta.Width, meta.Height),
+			})
+		}
+	}
+
+	return anomalies
+}
+
+// Share of eligible voters that voted at a TPS, see turnout
+func computeTurnout(adm Administrasi) float64 {
+	return turnout(int64(adm.PenggunaTotalJ), int64(adm.PemilihDPTJ), int64(adm.PenggunaDPTBJ), int64(adm.PenggunaNonDPTJ))
+}
+
+// Share of eligible voters that voted: pengguna_total / (pemilih_dpt + pengguna_dptb + pengguna_non_dpt),
+// as a fraction where 1 is 100%. Zero when nobody is registered, rather than NaN or Inf. Shared by the TPS
+// and the regional aggregates so both are comparable.
+func turnout(penggunaTotal, pemilihDPT, penggunaDPTB, penggunaNonDPT int64) float64 {
+	eligible := pemilihDPT + penggunaDPTB + penggunaNonDPT
+	if eligible == 0 {
+		return 0
+	}
+	return float64(penggunaTotal) / float64(eligible)
+}
+
+// Share of suara_sah of every candidate in the chart, in percent rounded to two decimals. The rounding uses
+// the largest remainder method, so the shares add up to the rounded total share instead of drifting
+// to 99.99 or 100.01. All zero when suara_sah is zero, rather than NaN or Inf.
+func computePercentages(chart map[string]int, suaraSah int) map[string]float64 {
+	if len(chart) == 0 {
+		return nil
+	}
+
+	candidates := make([]string, 0, len(chart))
+	for candidate := range chart {
+		candidates = append(candidates, candidate)
+	}
+	sort.Strings(candidates)
+
+	percentages := make(map[string]float64, len(chart))
+	if suaraSah <= 0 {
+		for _, candidate := range candidates {
+			percentages[candidate] = 0
+		}
+		return percentages
+	}
+
+	// Work in hundredths of a percent, each share is floored and the units lost to flooring are handed
+	// to the largest remainders, the earliest candidate winning ties
+	sah := int64(suaraSah)
+	hundredths := make(map[string]int64, len(chart))
+	remainders := make(map[string]int64, len(chart))
+	var total, floored int64
+	for _, candidate := range candidates {
+		scaled := int64(chart[candidate]) * 10000
+		total += scaled
+		hundredths[candidate] = scaled / sah
+		remainders[candidate] = scaled % sah
+		floored += hundredths[candidate]
+	}
+	target := (2*total + sah) / (2 * sah)
+
+	byRemainder := append([]string(nil), candidates...)
+	sort.SliceStable(byRemainder, func(i, j int) bool {
+		return remainders[byRemainder[i]] > remainders[byRemainder[j]]
+	})
+	for i := int64(0); i < target-floored && i < int64(len(byRemainder)); i++ {
+		hundredths[byRemainder[i]]++
+	}
+
+	for _, candidate := range candidates {
+		percentages[candidate] = float64(hundredths[candidate]) / 100
+	}
+	return percentages
+}
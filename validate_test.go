@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestComputePercentages(t *testing.T) {
+	tests := []struct {
+		name     string
+		chart    map[string]int
+		suaraSah int
+		want     map[string]float64
+	}{
+		{"exact", map[string]int{"a": 25, "b": 75}, 100, map[string]float64{"a": 25, "b": 75}},
+		{"thirds add up to 100", map[string]int{"a": 1, "b": 1, "c": 1}, 3, map[string]float64{"a": 33.34, "b": 33.33, "c": 33.33}},
+		{"largest remainder rounds up", map[string]int{"a": 2, "b": 2, "c": 3}, 7, map[string]float64{"a": 28.57, "b": 28.57, "c": 42.86}},
+		{"half rounds up", map[string]int{"a": 1, "b": 1}, 8, map[string]float64{"a": 12.5, "b": 12.5}},
+		{"chart below suara_sah", map[string]int{"a": 1, "b": 1}, 6, map[string]float64{"a": 16.67, "b": 16.66}},
+		{"no votes", map[string]int{"a": 0, "b": 0}, 10, map[string]float64{"a": 0, "b": 0}},
+		{"zero suara_sah", map[string]int{"a": 3, "b": 4}, 0, map[string]float64{"a": 0, "b": 0}},
+	}
+	for _, tt := range tests {
+		got := computePercentages(tt.chart, tt.suaraSah)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: computePercentages = %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for candidate, want := range tt.want {
+			if got[candidate] != want {
+				t.Errorf("%s: computePercentages = %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestComputePercentagesTotalIsStable(t *testing.T) {
+	// Every split of 7 valid votes over three candidates has to add up to exactly 100%
+	for a := 0; a <= 7; a++ {
+		for b := 0; a+b <= 7; b++ {
+			chart := map[string]int{"a": a, "b": b, "c": 7 - a - b}
+			total := 0
+			for _, share := range computePercentages(chart, 7) {
+				total += int(share*100 + 0.5)
+			}
+			if total != 10000 {
+				t.Errorf("computePercentages(%v) adds up to %.2f%%", chart, float64(total)/100)
+			}
+		}
+	}
+}
+
+func TestComputePercentagesEmptyChart(t *testing.T) {
+	if got := computePercentages(nil, 10); got != nil {
+		t.Errorf("computePercentages(nil) = %v, want nil", got)
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	// Every Administrasi field, KPU sends all of them once the form is entered
+	administrasi := func(overrides string) string {
+		fields := []string{}
+		for _, key := range []string{"suara_total", "pemilih_dpt_j", "pemilih_dpt_l", "pemilih_dpt_p", "pengguna_dpt_j", "pengguna_dpt_l",
+			"pengguna_dpt_p", "pengguna_dptb_j", "pengguna_dptb_l", "pengguna_dptb_p", "suara_tidak_sah", "pengguna_total_j", "pengguna_total_l",
+			"pengguna_total_p", "pengguna_non_dpt_j", "pengguna_non_dpt_l", "pengguna_non_dpt_p"} {
+			fields = append(fields, `"`+key+`":0`)
+		}
+		return "{" + strings.Join(append(fields, overrides), ",") + "}"
+	}
+	tests := []struct {
+		name     string
+		body     string
+		problems []string
+	}{
+		{"counted", `{"chart":{"100025":10,"100026":20},"images":["a.jpg",null],"administrasi":` + administrasi(`"suara_sah":30`) + `,"psu":null,"ts":"2024-02-15 10:00:00","status_suara":true,"status_adm":true}`, nil},
+		{"not counted", `{"chart":null,"administrasi":null,"status_suara":false,"status_adm":false}`, nil},
+		{"party chart", `{"chart":{"1":{"jml_suara_total":5}},"administrasi":null,"status_suara":true,"status_adm":true}`, nil},
+		{"unknown fields are fine", `{"chart":null,"administrasi":null,"status_suara":false,"status_adm":false,"new":1}`, nil},
+		{"missing status", `{"chart":null,"administrasi":null,"status_adm":false}`, []string{"response: missing status_suara"}},
+		{"string votes", `{"chart":{"100025":"10"},"administrasi":null,"status_suara":true,"status_adm":true}`, []string{"chart.100025: unexpected string"}},
+		{"fractional number", `{"chart":null,"administrasi":` + administrasi(`"suara_sah":1.5`) + `,"status_suara":true,"status_adm":true}`, []string{"administrasi.suara_sah: expected integer or null, got number"}},
+		{"renamed field", `{"chart":null,"administrasi":` + administrasi(`"suara_sah_total":30`) + `,"status_suara":true,"status_adm":true}`, []string{"administrasi: missing suara_sah"}},
+		{"renamed status", `{"chart":null,"administrasi":null,"status_suara":"true","status_adm":false}`, []string{"status_suara: expected boolean, got string"}},
+		{"not an object", `[]`, []string{"response: expected object, got array"}},
+	}
+	for _, tt := range tests {
+		err := checkSchema("tps.json", tpsSchema, []byte(tt.body))
+		if tt.problems == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		schemaErr, ok := err.(*SchemaError)
+		if !ok {
+			t.Errorf("%s: expected a SchemaError, got %v", tt.name, err)
+			continue
+		}
+		if strings.Join(schemaErr.Problems, "; ") != strings.Join(tt.problems, "; ") {
+			t.Errorf("%s: problems %q, want %q", tt.name, schemaErr.Problems, tt.problems)
+		}
+	}
+}
+
+func TestAggregateTurnoutCountsEveryEligibleVoter(t *testing.T) {
+	sink := &AggregateSink{}
+	for i := range sink.shards {
+		sink.shards[i].regions = map[string]*Aggregate{}
+		sink.shards[i].dirty = map[string]bool{}
+	}
+	// Every voter on the DPTB and outside the DPT voted, a turnout of exactly 100% at both TPS
+	for _, data := range []TPSData{
+		{Id: 1101012001001, Administrasi: Administrasi{PemilihDPTJ: 200, PenggunaDPTBJ: 10, PenggunaNonDPTJ: 5, PenggunaTotalJ: 215}},
+		{Id: 1101012001002, Administrasi: Administrasi{PemilihDPTJ: 100, PenggunaDPTBJ: 20, PenggunaTotalJ: 120}},
+	} {
+		if turnout := computeTurnout(data.Administrasi); turnout != 1 {
+			t.Fatalf("TPS %d turnout = %v, want 1", data.Id, turnout)
+		}
+		if err := sink.Store(context.Background(), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, region := range []string{"11", "1101", "110101", "1101012001"} {
+		agg := sink.shards[11%aggregateShards].regions[region]
+		if turnout := agg.turnout(); turnout != 1 {
+			t.Errorf("region %s turnout = %v, want 1", region, turnout)
+		}
+	}
+}
+
+func TestExportFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		query  string
+	}{
+		{"", "map[]"},
+		{"status_suara=true", "map[statussuara:true]"},
+		{"status_adm=false", "map[statusadm:false]"},
+		{"anomalies=true", "map[anomalies.0:map[$exists:true]]"},
+		{"anomalies=false", "map[anomalies.0:map[$exists:false]]"},
+		{"mode=HITUNG", "map[mode:map[$in:[hitung]]]"},
+		{"mode=koreksi|hitung, status_adm=true", "map[mode:map[$in:[hitung koreksi]] statusadm:true]"},
+	}
+	for _, tt := range tests {
+		filter, err := parseExportFilter(tt.filter)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.filter, err)
+			continue
+		}
+		if query := fmt.Sprint(filter.query()); query != tt.query {
+			t.Errorf("%q: query %s, want %s", tt.filter, query, tt.query)
+		}
+	}
+
+	for _, invalid := range []string{"status_suara", "status_suara=yes", "turnout=true"} {
+		if _, err := parseExportFilter(invalid); err == nil {
+			t.Errorf("%q: invalid filter accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A TPS to fetch, queued by fetchAndStoreTPS for the worker pool
+type tpsJob struct {
+	tps         Location
+	path        []PathEntry
+	stored      map[int64]time.Time
+	dataChannel chan<- TPSData
+	done        func(error)
+}
+
+// Queue shared by every village, the recursion only enqueues while a fixed pool of workers fetches
+var tpsJobs chan tpsJob
+
+// Start n workers fetching TPS from tpsJobs. The returned function stops the pool once nothing
+// will be enqueued anymore and waits for the workers to finish.
+func startTPSWorkers(ctx context.Context, n int) func() {
+	tpsJobs = make(chan tpsJob)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range tpsJobs {
+				job.done(processTPS(ctx, job))
+			}
+		}()
+	}
+
+	return func() {
+		close(tpsJobs)
+		wg.Wait()
+	}
+}
+
+// Fetch a single TPS and send it on the data channel if it should be stored. A failed fetch is only
+// recorded, nothing is ever sent for it.
+func processTPS(ctx context.Context, job tpsJob) error {
+	subLoc := job.tps
+	ctx, span := startSpan(ctx, "processTPS", subLoc.Kode)
+	defer span.End()
+	var data TPSData
+	tpsURL, err := buildTPSURL(subLoc)
+	attempts := 0
+	if err == nil {
+		attempts, err = withRetry(ctx, func() (err error) {
+			data, err = fetchDataTPS(ctx, tpsURL)
+			return err
+		})
+	}
+	tpsProcessed.Add(1)
+	if err != nil {
+		recordFailure(ctx, tpsURL, subLoc.Kode, err, attempts)
+		return spanError(span, fmt.Errorf("TPS %s: %w", subLoc.Kode, err))
+	}
+	if data.StatusSuara {
+		suaraCounted.Add(1)
+	} else {
+		suaraNotCounted.Add(1)
+	}
+
+	data.Id, _ = strconv.ParseInt(subLoc.Kode, 10, 64)
+	data.Path = appendPath(job.path, subLoc)
+	if len(job.path) > 0 {
+		data.Stale = staleTPS.observe(data, job.path[len(job.path)-1].Kode)
+	}
+	if data.Stale {
+		staleFound.Add(1)
+	}
+	// A stale TPS is stored even when unchanged, that's the point of flagging it
+	if !shouldStore(data) || (!isUpdated(data, job.stored) && !data.Stale) {
+		return nil
+	}
+
+	// Scans are fetched once for everything made of them, and first since a blank one is an anomaly too
+	if downloadImages || hashImagesEnabled || imageMetadataEnabled {
+		data = processImages(ctx, data)
+	}
+
+	// Flag inconsistent numbers instead of dropping the record
+	data = deriveTPS(data)
+	if unknown := unknownCandidates(data.Chart); rejectUnknownCandidates && len(unknown) > 0 {
+		err := &UnknownCandidateError{URL: tpsURL, Keys: unknown}
+		recordFailure(ctx, tpsURL, subLoc.Kode, err, attempts)
+		return spanError(span, fmt.Errorf("TPS %s: %w", subLoc.Kode, err))
+	}
+	anomaliesFound.Add(int64(len(data.Anomalies)))
+	alerts.notify(data)
+	if rawDir != "" && data.Raw != nil {
+		err := saveRaw(data.Id, data.Raw)
+		if err != nil {
+			fmt.Println("Error saving raw response:", data.Id, err)
+		}
+		data.Raw = nil
+	}
+	data.spanContext = span.SpanContext()
+	err = sendData(ctx, job.dataChannel, data)
+	if err != nil {
+		return spanError(span, fmt.Errorf("TPS %s: %w", subLoc.Kode, err))
+	}
+	return nil
+}
+
+// Fill in everything computed from the numbers themselves, without touching the network
+func deriveTPS(data TPSData) TPSData {
+	data.Anomalies = validateAdministrasi(data)
+	data.Turnout = computeTurnout(data.Administrasi)
+	data.Votes = namedVotes(data.Chart)
+	data.Percentages = computePercentages(data.Chart, data.Administrasi.SuaraSah)
+	return data
+}
+
+// Which TPS are stored, by whether their votes (status_suara) and administrasi (status_adm) are complete
+const (
+	storeSuara  = "suara"
+	storeAdm    = "adm"
+	storeEither = "either"
+	storeAll    = "all"
+)
+
+var storeFilter = storeSuara
+
+func parseStoreFilter(value string) (string, error) {
+	switch value {
+	case "":
+		return storeSuara, nil
+	case storeSuara, storeAdm, storeEither, storeAll:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid STORE_FILTER %q, expected suara, adm, either or all", value)
+}
+
+func shouldStore(data TPSData) bool {
+	switch storeFilter {
+	case storeAdm:
+		return data.StatusAdm
+	case storeEither:
+		return data.StatusSuara || data.StatusAdm
+	case storeAll:
+		return true
+	}
+	return data.StatusSuara
+}